@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/alvarofc/mode/mailer"
+	"github.com/golang-jwt/jwt"
+)
+
+// Purposes of single-use account tokens. They double as the JWT audience so a
+// token minted for one flow can't be replayed against another.
+const (
+	tokenPurposeVerifyEmail   = "verify_email"
+	tokenPurposePasswordReset = "password_reset"
+)
+
+const (
+	verifyEmailTokenTTL   = 48 * time.Hour
+	passwordResetTokenTTL = 1 * time.Hour
+)
+
+var errInvalidAccountToken = errors.New("invalid or expired token")
+
+// randomToken returns n random bytes encoded as URL-safe base64
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueAccountToken creates a signed token for purpose and records its ID so it can be redeemed once
+func (s *Server) issueAccountToken(ctx context.Context, userID int, purpose string, ttl time.Duration) (string, error) {
+	jti, err := randomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("error generating token id: %w", err)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	claims := &jwt.StandardClaims{
+		Audience:  purpose,
+		ExpiresAt: expiresAt.Unix(),
+		Id:        jti,
+		IssuedAt:  now.Unix(),
+		Subject:   strconv.Itoa(userID),
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(signKey)
+	if err != nil {
+		return "", fmt.Errorf("error signing token: %w", err)
+	}
+
+	if err := s.store.CreateAccountToken(ctx, userID, purpose, hashToken(jti), expiresAt); err != nil {
+		return "", fmt.Errorf("error storing token: %w", err)
+	}
+
+	return tokenString, nil
+}
+
+// consumeAccountToken checks the token signature and purpose and redeems it, returning the user it was issued to
+func (s *Server) consumeAccountToken(ctx context.Context, tokenString, purpose string) (int, error) {
+	claims := &jwt.StandardClaims{}
+	token, err := parseToken(tokenString, claims)
+	if err != nil || !token.Valid || !claims.VerifyAudience(purpose, true) || claims.Id == "" {
+		return 0, errInvalidAccountToken
+	}
+
+	userID, err := s.store.ConsumeAccountToken(ctx, purpose, hashToken(claims.Id))
+	if err != nil {
+		return 0, errInvalidAccountToken
+	}
+	if strconv.Itoa(userID) != claims.Subject {
+		return 0, errInvalidAccountToken
+	}
+
+	return userID, nil
+}
+
+// accountLink builds a link to the frontend page that completes an account flow
+func accountLink(r *http.Request, path, token string) string {
+	return fmt.Sprintf("%s%s?token=%s", appURL(r), path, url.QueryEscape(token))
+}
+
+// sendMail delivers msg in the background so response times don't depend on the mail server
+func (s *Server) sendMail(msg mailer.Message) {
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			log.Printf("Error sending %q email: %v", msg.Subject, err)
+		}
+	}()
+}
+
+func (s *Server) sendVerificationEmail(r *http.Request, userID int, email string) error {
+	token, err := s.issueAccountToken(r.Context(), userID, tokenPurposeVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(mailer.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: "Welcome to Mode! Confirm your email address by opening the link below:\n\n" +
+			accountLink(r, "/verify-email", token) + "\n\n" +
+			"If you didn't create an account, you can ignore this email.\n",
+	})
+	return nil
+}
+
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := s.consumeAccountToken(r.Context(), req.Token, tokenPurposeVerifyEmail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.store.MarkEmailVerified(r.Context(), userID); err != nil {
+		log.Printf("Error marking email verified for user %d: %v", userID, err)
+		http.Error(w, "Error verifying email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified successfully"})
+}
+
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		writeFieldErrors(w, http.StatusBadRequest, []fieldError{{Field: "email", Message: err.Error()}})
+		return
+	}
+
+	// The response is the same whether or not the account exists, so this
+	// endpoint can't be used to find out which emails are registered
+	user, err := s.store.GetUserByEmail(r.Context(), email)
+	if err == nil {
+		token, err := s.issueAccountToken(r.Context(), user.ID, tokenPurposePasswordReset, passwordResetTokenTTL)
+		if err != nil {
+			log.Printf("Error issuing password reset token for user %d: %v", user.ID, err)
+		} else {
+			s.sendMail(mailer.Message{
+				To:      user.Email,
+				Subject: "Reset your password",
+				Body: "Someone asked to reset the password for your Mode account. Choose a new password here:\n\n" +
+					accountLink(r, "/password/reset", token) + "\n\n" +
+					"The link expires in one hour. If you didn't ask for this, you can ignore this email.\n",
+			})
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a password reset email has been sent"})
+}
+
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Password == "" {
+		writeFieldErrors(w, http.StatusBadRequest, []fieldError{{Field: "password", Message: "is required"}})
+		return
+	}
+	if errs := passwordFieldErrors("password", req.Password, ""); len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	userID, err := s.consumeAccountToken(r.Context(), req.Token, tokenPurposePasswordReset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Updating the password also signs out every session issued before now
+	if err := s.store.UpdatePassword(r.Context(), userID, req.Password); err != nil {
+		log.Printf("Error updating password for user %d: %v", userID, err)
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+	// Other reset links sent before this one must not change the password back
+	if err := s.store.DeleteAccountTokens(r.Context(), userID, tokenPurposePasswordReset); err != nil {
+		log.Printf("Error deleting the reset tokens of user %d: %v", userID, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+}
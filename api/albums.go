@@ -0,0 +1,298 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/types"
+)
+
+const maxAlbumNameLength = 100
+
+// albumNameErrors validates the name of an album, returning it trimmed
+func albumNameErrors(name string) (string, []fieldError) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return name, []fieldError{{Field: "name", Message: "is required"}}
+	case utf8.RuneCountInString(name) > maxAlbumNameLength:
+		return name, []fieldError{{Field: "name", Message: fmt.Sprintf("must be at most %d characters", maxAlbumNameLength)}}
+	}
+	return name, nil
+}
+
+// photoKeyErrors rejects keys that don't belong to the user, so albums can't reference other users' photos
+func photoKeyErrors(field string, userID int, keys []string) []fieldError {
+	var errs []fieldError
+	for _, key := range keys {
+		if !ownsPhoto(userID, key) {
+			errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf("%q is not one of your photos", key)})
+		}
+	}
+	return errs
+}
+
+// albumRequest reads the signed-in user and the album ID from the path
+func albumRequest(w http.ResponseWriter, r *http.Request) (userID, albumID int, ok bool) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, 0, false
+	}
+	albumID, err = strconv.Atoi(r.PathValue("album_id"))
+	if err != nil {
+		http.Error(w, "Album not found", http.StatusNotFound)
+		return 0, 0, false
+	}
+	return userID, albumID, true
+}
+
+// writeAlbumError maps storage errors of the album methods to responses
+func writeAlbumError(w http.ResponseWriter, albumID int, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Album not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrInvalidOrder):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error updating album %d: %v", albumID, err)
+		http.Error(w, "Error updating album", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleListAlbums(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	albums, err := s.store.ListAlbums(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if albums == nil {
+		albums = []types.Album{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(albums)
+}
+
+func (s *Server) handleCreateAlbum(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, errs := albumNameErrors(req.Name)
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	album, err := s.store.CreateAlbum(r.Context(), userID, name)
+	if err != nil {
+		log.Printf("Error creating album for user %d: %v", userID, err)
+		http.Error(w, "Error creating album", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(album)
+}
+
+// handleGetAlbum returns an album with its photos in order, each with a presigned URL
+func (s *Server) handleGetAlbum(w http.ResponseWriter, r *http.Request) {
+	userID, albumID, ok := albumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	album, err := s.store.GetAlbum(r.Context(), userID, albumID)
+	if err != nil {
+		writeAlbumError(w, albumID, err)
+		return
+	}
+	photos, err := s.store.AlbumPhotos(r.Context(), userID, albumID)
+	if err != nil {
+		writeAlbumError(w, albumID, err)
+		return
+	}
+
+	images := make([]*types.ImageInfo, len(photos))
+	for i := range photos {
+		images[i] = &photos[i]
+	}
+	if err := s.presignImages(r.Context(), ownerListingMetadata, images...); err != nil {
+		log.Printf("Error listing album %d: %v", albumID, err)
+		http.Error(w, "Error generating presigned URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"album":  album,
+		"photos": photos,
+	})
+}
+
+// handleUpdateAlbum renames an album and/or sets its cover; omitted fields are left unchanged
+func (s *Server) handleUpdateAlbum(w http.ResponseWriter, r *http.Request) {
+	userID, albumID, ok := albumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name     *string `json:"name"`
+		CoverKey *string `json:"cover_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil {
+		name, errs := albumNameErrors(*req.Name)
+		if len(errs) > 0 {
+			writeFieldErrors(w, http.StatusBadRequest, errs)
+			return
+		}
+		if err := s.store.RenameAlbum(r.Context(), userID, albumID, name); err != nil {
+			writeAlbumError(w, albumID, err)
+			return
+		}
+	}
+
+	if req.CoverKey != nil {
+		err := s.store.SetAlbumCover(r.Context(), userID, albumID, *req.CoverKey)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeFieldErrors(w, http.StatusBadRequest, []fieldError{{Field: "cover_key", Message: "must be a photo in the album"}})
+			return
+		}
+		if err != nil {
+			writeAlbumError(w, albumID, err)
+			return
+		}
+	}
+
+	album, err := s.store.GetAlbum(r.Context(), userID, albumID)
+	if err != nil {
+		writeAlbumError(w, albumID, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(album)
+}
+
+// handleDeleteAlbum deletes an album but not its photos
+func (s *Server) handleDeleteAlbum(w http.ResponseWriter, r *http.Request) {
+	userID, albumID, ok := albumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteAlbum(r.Context(), userID, albumID); err != nil {
+		writeAlbumError(w, albumID, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// albumKeysRequest decodes {"keys": [...]} and checks that every key belongs to the user
+func albumKeysRequest(w http.ResponseWriter, r *http.Request, userID int) ([]string, bool) {
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if errs := photoKeyErrors("keys", userID, req.Keys); len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return nil, false
+	}
+	return req.Keys, true
+}
+
+func (s *Server) handleAddAlbumPhotos(w http.ResponseWriter, r *http.Request) {
+	userID, albumID, ok := albumRequest(w, r)
+	if !ok {
+		return
+	}
+	keys, ok := albumKeysRequest(w, r, userID)
+	if !ok {
+		return
+	}
+	if len(keys) == 0 {
+		writeFieldErrors(w, http.StatusBadRequest, []fieldError{{Field: "keys", Message: "is required"}})
+		return
+	}
+
+	err := s.store.AddAlbumPhotos(r.Context(), userID, albumID, keys)
+	if errors.Is(err, storage.ErrPhotoNotFound) {
+		writeFieldErrors(w, http.StatusBadRequest, []fieldError{{Field: "keys", Message: "must all be photos in your library"}})
+		return
+	}
+	if err != nil {
+		writeAlbumError(w, albumID, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReorderAlbumPhotos replaces the order of the album's photos
+func (s *Server) handleReorderAlbumPhotos(w http.ResponseWriter, r *http.Request) {
+	userID, albumID, ok := albumRequest(w, r)
+	if !ok {
+		return
+	}
+	keys, ok := albumKeysRequest(w, r, userID)
+	if !ok {
+		return
+	}
+
+	if err := s.store.ReorderAlbumPhotos(r.Context(), userID, albumID, keys); err != nil {
+		writeAlbumError(w, albumID, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRemoveAlbumPhoto takes a photo out of an album without deleting it
+func (s *Server) handleRemoveAlbumPhoto(w http.ResponseWriter, r *http.Request) {
+	userID, albumID, ok := albumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.store.RemoveAlbumPhoto(r.Context(), userID, albumID, r.PathValue("key")); err != nil {
+		writeAlbumError(w, albumID, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/alvarofc/mode/storage"
 	"github.com/alvarofc/mode/types"
 	"github.com/golang-jwt/jwt"
 
@@ -69,18 +71,44 @@ func (s *Server) handleSignUp(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate user input
-	if user.Email == "" || user.Password == "" {
-		http.Error(w, "Email and password are required", http.StatusBadRequest)
+	var errs []fieldError
+	email, err := normalizeEmail(user.Email)
+	switch {
+	case user.Email == "":
+		errs = append(errs, fieldError{Field: "email", Message: "is required"})
+	case err != nil:
+		errs = append(errs, fieldError{Field: "email", Message: err.Error()})
+	}
+	if user.Password == "" {
+		errs = append(errs, fieldError{Field: "password", Message: "is required"})
+	} else {
+		errs = append(errs, passwordFieldErrors("password", user.Password, email)...)
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
 		return
 	}
+	user.Email = email
 
 	// Create user
-	err = s.store.CreateUser(user.Email, user.Password)
+	err = s.store.CreateUser(r.Context(), user.Email, user.Password)
 	if err != nil {
-		http.Error(w, "Error creating user: "+err.Error(), http.StatusInternalServerError)
+		if errors.Is(err, storage.ErrDuplicateEmail) {
+			writeFieldErrors(w, http.StatusConflict, []fieldError{{Field: "email", Message: "is already registered"}})
+			return
+		}
+		log.Printf("Error creating user %s: %v", user.Email, err)
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
 
+	created, err := s.store.GetUserByEmail(r.Context(), user.Email)
+	if err != nil {
+		log.Printf("Error loading new user %s: %v", user.Email, err)
+	} else if err := s.sendVerificationEmail(r, created.ID, created.Email); err != nil {
+		log.Printf("Error sending verification email to user %d: %v", created.ID, err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User created successfully"})
 }
@@ -92,55 +120,93 @@ func (s *Server) handleSignIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := s.store.GetUserByEmail(creds.Email)
-	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	// The limiter keys the address the lookup uses, so spellings of it can't each get their own failures
+	if email, err := normalizeEmail(creds.Email); err == nil {
+		creds.Email = email
+	}
+	emailKey, ipKey := loginEmailKey(creds.Email), loginIPKey(clientIP(r))
+	if wait := s.logins.retryAfter(emailKey, ipKey); wait > 0 {
+		tooManyAttempts(w, wait)
 		return
 	}
 
-	if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password)); err != nil {
+	// Always run bcrypt so unknown emails can't be told apart by response time
+	user, lookupErr := s.store.GetUserByEmail(r.Context(), creds.Email)
+	hash := dummyPasswordHash
+	if lookupErr == nil {
+		hash = []byte(user.Password)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(creds.Password)); err != nil || lookupErr != nil {
+		s.logins.fail(emailKey, ipKey)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
+	if os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true" && !user.EmailVerified {
+		http.Error(w, "Email address not verified", http.StatusForbidden)
+		return
+	}
+
+	// With 2FA enabled the password alone doesn't get a session; the client
+	// trades the pre-auth token and a code for one at /signin/2fa
+	if user.TOTPEnabled {
+		preAuthToken, err := s.issuePreAuthToken(r.Context(), user.ID)
+		if err != nil {
+			log.Printf("Error signing token: %v", err)
+			http.Error(w, "Error creating token", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"two_factor_required": true,
+			"pre_auth_token":      preAuthToken,
+		})
+		return
+	}
+
+	csrfToken, err := s.issueSession(w, r, user)
+	if err != nil {
+		log.Printf("Error signing token: %v", err)
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+	// Failures are only forgiven once the sign-in is complete; a right password alone would
+	// otherwise reset the count for whoever is guessing the second factor
+	s.logins.succeed(emailKey)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Successfully signed in", "csrf_token": csrfToken})
+}
+
+// issueSession signs a session token for user and sets it as the mode_session cookie
+// It also issues the CSRF token that state-changing requests must echo back, and returns it
+func (s *Server) issueSession(w http.ResponseWriter, r *http.Request, user types.User) (string, error) {
+	now := time.Now()
+	expirationTime := now.Add(24 * time.Hour)
 	claims := &jwt.StandardClaims{
 		ExpiresAt: expirationTime.Unix(),
+		IssuedAt:  now.Unix(),
 		Subject:   strconv.Itoa(user.ID),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 	tokenString, err := token.SignedString(signKey)
 	if err != nil {
-		log.Printf("Error signing token: %v", err)
-		http.Error(w, "Error creating token", http.StatusInternalServerError)
-		return
+		return "", err
 	}
 
-	// Get the host from the request
-	host := r.Host
-	// If you're behind a proxy, you might need to use:
-	// host := r.Header.Get("X-Forwarded-Host")
-
-	isSecure := r.TLS != nil
-	// If you're behind a proxy, you might need to check a header instead:
-	// isSecure := r.Header.Get("X-Forwarded-Proto") == "https"
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "mode_session",
-		Value:    tokenString,
-		Expires:  expirationTime,
-		HttpOnly: true,
-		Secure:   isSecure,             // Only set Secure flag if using HTTPS
-		SameSite: http.SameSiteLaxMode, // Try Lax mode
-		Path:     "/",
-		Domain:   host, // Set the domain explicitly
-	})
+	http.SetCookie(w, newCookie(r, "mode_session", tokenString, "/", expirationTime, true))
 
-	// Log cookie setting for debugging
-	log.Printf("Setting cookie for domain: %s, secure: %v", host, isSecure)
+	return setCSRFCookie(w, r, expirationTime)
+}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Successfully signed in"})
+// parseToken parses a token signed with our RSA key into claims
+func parseToken(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return verifyKey, nil
+	})
 }
 
 // VerifyToken verifies the JWT token
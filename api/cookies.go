@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// cookiePolicy controls the attributes of the cookies the API sets
+type cookiePolicy struct {
+	// domain is empty for host-only cookies
+	domain string
+	// secure is "auto" (follow the request scheme), "true" or "false"
+	secure   string
+	sameSite http.SameSite
+}
+
+var (
+	cookieRules = &cookiePolicy{secure: "auto", sameSite: http.SameSiteLaxMode}
+	// trustedProxies are the peers whose X-Forwarded-* headers are believed
+	trustedProxies []*net.IPNet
+)
+
+// InitializeCookiePolicy loads cookie and proxy settings from environment variables
+// COOKIE_DOMAIN sets the cookie domain (host-only when empty), COOKIE_SECURE is auto, true or false,
+// COOKIE_SAMESITE is lax, strict or none, and TRUSTED_PROXIES lists the IPs or CIDRs of reverse
+// proxies allowed to report the original scheme, host and client address.
+func InitializeCookiePolicy() error {
+	policy := &cookiePolicy{
+		domain:   os.Getenv("COOKIE_DOMAIN"),
+		secure:   "auto",
+		sameSite: http.SameSiteLaxMode,
+	}
+
+	switch v := strings.ToLower(os.Getenv("COOKIE_SECURE")); v {
+	case "", "auto":
+	case "true", "false":
+		policy.secure = v
+	default:
+		return fmt.Errorf("COOKIE_SECURE must be auto, true or false, got %q", v)
+	}
+
+	switch v := strings.ToLower(os.Getenv("COOKIE_SAMESITE")); v {
+	case "", "lax":
+	case "strict":
+		policy.sameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers drop SameSite=None cookies that aren't Secure
+		if policy.secure == "false" {
+			return fmt.Errorf("COOKIE_SAMESITE=none requires secure cookies")
+		}
+		policy.sameSite = http.SameSiteNoneMode
+		policy.secure = "true"
+	default:
+		return fmt.Errorf("COOKIE_SAMESITE must be lax, strict or none, got %q", v)
+	}
+
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+
+	cookieRules = policy
+	trustedProxies = proxies
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address of the direct peer
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// fromTrustedProxy reports whether X-Forwarded-* headers on r can be believed
+func fromTrustedProxy(r *http.Request) bool {
+	ip := remoteIP(r)
+	return ip != nil && isTrustedProxy(ip)
+}
+
+// clientIP returns the address the request came from
+// Behind trusted proxies it is the right-most X-Forwarded-For entry that isn't itself a trusted proxy
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip.String()
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// requestIsSecure reports whether the client reached us over HTTPS
+func requestIsSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return fromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// requestOrigin returns the scheme and host the client used to reach us
+func requestOrigin(r *http.Request) string {
+	host := r.Host
+	if fromTrustedProxy(r) {
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	scheme := "http"
+	if requestIsSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + host
+}
+
+// appURL returns the frontend base URL, falling back to the origin of the request
+func appURL(r *http.Request) string {
+	if u := os.Getenv("APP_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return requestOrigin(r)
+}
+
+// newCookie builds a cookie following the configured policy
+func newCookie(r *http.Request, name, value, path string, expires time.Time, httpOnly bool) *http.Cookie {
+	secure := cookieRules.secure == "true" || (cookieRules.secure == "auto" && requestIsSecure(r))
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  expires,
+		HttpOnly: httpOnly,
+		Secure:   secure,
+		SameSite: cookieRules.sameSite,
+		Path:     path,
+		Domain:   cookieRules.domain,
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy decides which browser origins may call the API
+type corsPolicy struct {
+	allowAll         bool
+	allowedOrigins   map[string]bool
+	allowedMethods   string
+	allowedHeaders   string
+	allowCredentials bool
+	maxAge           string
+}
+
+// By default no cross-origin requests are allowed
+var corsRules = &corsPolicy{}
+
+// InitializeCORSPolicy loads the CORS policy from environment variables
+// CORS_ALLOWED_ORIGINS is a comma separated list of origins (or "*"); CORS_ALLOWED_METHODS,
+// CORS_ALLOWED_HEADERS, CORS_ALLOW_CREDENTIALS and CORS_MAX_AGE (seconds) tune the preflight response.
+func InitializeCORSPolicy() error {
+	policy := &corsPolicy{
+		allowedOrigins:   make(map[string]bool),
+		allowedMethods:   "GET, POST, PUT, PATCH, DELETE",
+		allowedHeaders:   "Content-Type, Authorization, X-CSRF-Token",
+		allowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+		maxAge:           "600",
+	}
+
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+		case "*":
+			policy.allowAll = true
+		default:
+			policy.allowedOrigins[origin] = true
+		}
+	}
+	if policy.allowAll && policy.allowCredentials {
+		return errors.New("CORS_ALLOWED_ORIGINS=* can't be combined with CORS_ALLOW_CREDENTIALS=true; list the origins instead")
+	}
+
+	if v := os.Getenv("CORS_ALLOWED_METHODS"); v != "" {
+		policy.allowedMethods = v
+	}
+	if v := os.Getenv("CORS_ALLOWED_HEADERS"); v != "" {
+		policy.allowedHeaders = v
+	}
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		if _, err := strconv.Atoi(v); err != nil {
+			return errors.New("CORS_MAX_AGE must be a number of seconds")
+		}
+		policy.maxAge = v
+	}
+
+	corsRules = policy
+	return nil
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	return p.allowAll || p.allowedOrigins[origin]
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers preflight requests
+// It wraps the whole mux, since preflights must be answered before method-specific routes are matched
+func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if origin == "" || !corsRules.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if corsRules.allowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", corsRules.allowedMethods)
+			h.Set("Access-Control-Allow-Headers", corsRules.allowedHeaders)
+			h.Set("Access-Control-Max-Age", corsRules.maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", "Retry-After")
+		next.ServeHTTP(w, r)
+	}
+}
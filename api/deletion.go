@@ -0,0 +1,287 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// reauthWindow is how recent a sign-in must be to stand in for the password when deleting an account
+const reauthWindow = 5 * time.Minute
+
+// handleDeleteUser deletes the signed-in user's account once they prove it is them again
+// That takes their password, a TOTP or recovery code, or, for accounts without 2FA, a sign-in in the
+// last reauthWindow, which is how accounts that only use a social login re-authenticate. A code is
+// always required when 2FA is enabled.
+// The catalog rows go at once, leaving only a deletion record; the files are removed by the account
+// purger, which is started right away and retries on its schedule until it succeeds.
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	account, err := s.store.GetUserById(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Only the lookup by email returns the password hash
+	user, err := s.store.GetUserByEmail(r.Context(), account.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A stolen session shouldn't be enough to guess the password, so attempts count against sign-in limits
+	emailKey, ipKey := loginEmailKey(user.Email), loginIPKey(clientIP(r))
+	if wait := s.logins.retryAfter(emailKey, ipKey); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	switch {
+	case req.Password != "":
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+			s.logins.fail(emailKey, ipKey)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+	case account.TOTPEnabled:
+		// The code checked below re-authenticates on its own
+	case !recentSignIn(r):
+		writeFieldErrors(w, http.StatusBadRequest, []fieldError{{
+			Field:   "password",
+			Message: fmt.Sprintf("is required to delete the account, unless you signed in within the last %v", reauthWindow),
+		}})
+		return
+	}
+	if account.TOTPEnabled {
+		switch err := s.verifySecondFactor(r.Context(), account, req.Code, req.RecoveryCode); {
+		case errors.Is(err, errSecondFactorRequired):
+			http.Error(w, "A code or recovery code is required", http.StatusBadRequest)
+			return
+		case errors.Is(err, errInvalidSecondFactor):
+			s.logins.fail(emailKey, ipKey)
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		case err != nil:
+			log.Printf("Error checking the second factor of user %d: %v", userID, err)
+			http.Error(w, "Error deleting account", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.logins.succeed(emailKey)
+
+	deletion, err := s.store.DeleteUser(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting user %d: %v", userID, err)
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Deleted user %d (deletion %d)", userID, deletion.ID)
+
+	// Sessions of a deleted user are refused by authMiddleware; clearing the cookies signs this one out
+	expired := time.Unix(0, 0)
+	for _, cookie := range []*http.Cookie{
+		newCookie(r, "mode_session", "", "/", expired, true),
+		newCookie(r, csrfCookieName, "", "/", expired, false),
+	} {
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+
+	go func() {
+		if _, err := s.purgeDeletedAccounts(context.Background()); err != nil {
+			log.Printf("Error purging deleted accounts: %v", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deletion)
+}
+
+// runAccountPurger removes the files of deleted accounts on the trash purge schedule until ctx is done
+func (s *Server) runAccountPurger(ctx context.Context) {
+	ticker := time.NewTicker(trashRules.interval)
+	defer ticker.Stop()
+
+	for {
+		if purged, err := s.purgeDeletedAccounts(ctx); err != nil {
+			log.Printf("Error purging deleted accounts: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged the files of %d deleted accounts", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeDeletedAccounts removes every object under the prefixes of deleted accounts
+// A deletion is only marked purged once its objects are gone, so failures are retried on the next run.
+func (s *Server) purgeDeletedAccounts(ctx context.Context) (int, error) {
+	const batchSize = 100
+
+	purged := 0
+	for {
+		deletions, err := s.store.PendingAccountPurges(ctx, batchSize)
+		if err != nil {
+			return purged, err
+		}
+
+		for _, deletion := range deletions {
+			if err := s.s3.PurgeUser(ctx, strconv.Itoa(deletion.UserID)); err != nil {
+				return purged, fmt.Errorf("purging user %d: %w", deletion.UserID, err)
+			}
+			if err := s.store.MarkAccountPurged(ctx, deletion.ID); err != nil {
+				return purged, fmt.Errorf("marking deletion %d purged: %w", deletion.ID, err)
+			}
+			purged++
+		}
+
+		if len(deletions) < batchSize {
+			return purged, nil
+		}
+	}
+}
+
+// personalAccount is the account part of a personal data export; credentials are left out
+type personalAccount struct {
+	ID            int    `json:"id"`
+	Email         string `json:"email"`
+	Name          string `json:"name,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+	TOTPEnabled   bool   `json:"totp_enabled"`
+	StripMetadata bool   `json:"strip_metadata"`
+}
+
+// personalAlbum is an album with the keys of its photos, in order
+type personalAlbum struct {
+	types.Album
+	Photos []string `json:"photos"`
+}
+
+// personalData is everything stored about a user, as returned by GET /user/data
+type personalData struct {
+	GeneratedAt time.Time            `json:"generated_at"`
+	Account     personalAccount      `json:"account"`
+	Identities  []types.Identity     `json:"identities"`
+	Photos      []types.PhotoDetails `json:"photos"`
+	Trash       []types.TrashedPhoto `json:"trash"`
+	Albums      []personalAlbum      `json:"albums"`
+	Shares      []types.Share        `json:"shares"`
+}
+
+// handleGetPersonalData returns the personal data held about the user as a JSON download
+// It covers the database; the photos themselves are downloaded with an export (POST /export).
+func (s *Server) handleGetPersonalData(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+
+	user, err := s.store.GetUserById(ctx, userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	data := personalData{
+		GeneratedAt: time.Now(),
+		Account: personalAccount{
+			ID:            user.ID,
+			Email:         user.Email,
+			Name:          user.Name,
+			EmailVerified: user.EmailVerified,
+			TOTPEnabled:   user.TOTPEnabled,
+			StripMetadata: user.StripMetadata,
+		},
+		Albums: []personalAlbum{},
+	}
+
+	if data.Identities, err = s.store.ListIdentities(ctx, userID); err == nil {
+		if data.Photos, err = s.store.SearchPhotos(ctx, userID, storage.PhotoQuery{}); err == nil {
+			if data.Trash, err = s.store.ListTrash(ctx, userID); err == nil {
+				data.Shares, err = s.store.ListShares(ctx, userID)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error collecting the personal data of user %d: %v", userID, err)
+		http.Error(w, "Error collecting personal data", http.StatusInternalServerError)
+		return
+	}
+
+	images := make([]*types.ImageInfo, len(data.Photos))
+	for i := range data.Photos {
+		images[i] = &data.Photos[i].ImageInfo
+	}
+	// Unlike listings, the export is for the owner alone and keeps the location
+	s.attachImageMetadata(ctx, ownerMetadata, images...)
+
+	albums, err := s.store.ListAlbums(ctx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, album := range albums {
+		photos, err := s.store.AlbumPhotos(ctx, userID, album.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		keys := make([]string, len(photos))
+		for i, photo := range photos {
+			keys[i] = photo.Key
+		}
+		data.Albums = append(data.Albums, personalAlbum{Album: album, Photos: keys})
+	}
+
+	if data.Identities == nil {
+		data.Identities = []types.Identity{}
+	}
+	if data.Photos == nil {
+		data.Photos = []types.PhotoDetails{}
+	}
+	if data.Trash == nil {
+		data.Trash = []types.TrashedPhoto{}
+	}
+	if data.Shares == nil {
+		data.Shares = []types.Share{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="mode-personal-data.json"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(data)
+}
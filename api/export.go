@@ -0,0 +1,169 @@
+package api
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/types"
+)
+
+// exportTTL is how long an export can be downloaded after it is requested
+const exportTTL = 24 * time.Hour
+
+// exportEntry describes a photo of an export in its manifest
+type exportEntry struct {
+	Key string `json:"key"`
+	// Path is where the photo is in the archive
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	types.PhotoMetadata
+	// EXIF is the catalog's copy, which the stored photo may no longer carry
+	EXIF *types.EXIF `json:"exif,omitempty"`
+}
+
+// exportManifest is written to manifest.json, after the photos it lists
+type exportManifest struct {
+	ExportID    int           `json:"export_id"`
+	UserID      int           `json:"user_id"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Photos      []exportEntry `json:"photos"`
+}
+
+// handleCreateExport starts an export of the user's library, downloadable from its URL until it expires
+func (s *Server) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	export, err := s.store.CreateExport(r.Context(), userID, time.Now().Add(exportTTL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	export.URL = requestOrigin(r) + "/export/" + strconv.Itoa(export.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(export)
+}
+
+// handleDownloadExport streams the user's photos and a manifest as a ZIP archive
+// Photos are copied from the file store into the response one at a time as the listing is paged
+// through, so neither the archive nor a photo is ever held in memory.
+func (s *Server) handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	exportID, err := strconv.Atoi(r.PathValue("export_id"))
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	export, err := s.store.GetExport(r.Context(), userID, exportID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if export.Expired(time.Now()) {
+		http.Error(w, "Export has expired", http.StatusGone)
+		return
+	}
+
+	// The catalog holds the prompts, tags and EXIF data that go into the manifest
+	photos, err := s.store.SearchPhotos(r.Context(), userID, storage.PhotoQuery{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	catalog := make(map[string]types.PhotoMetadata, len(photos))
+	keys := make([]string, len(photos))
+	for i, photo := range photos {
+		catalog[photo.Key] = photo.PhotoMetadata
+		keys[i] = photo.Key
+	}
+	metadata, err := s.store.ImageMetadata(r.Context(), keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="mode-export-%d.zip"`, export.ID))
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	zw := zip.NewWriter(w)
+	manifest := exportManifest{ExportID: export.ID, UserID: userID, GeneratedAt: time.Now(), Photos: []exportEntry{}}
+	prefix := fmt.Sprintf("user_%d/", userID)
+
+	err = s.s3.WalkPhotos(r.Context(), strconv.Itoa(userID), func(image types.ImageInfo) error {
+		body, err := s.s3.OpenPhoto(r.Context(), image.Key)
+		// Deleted since it was listed
+		if errors.Is(err, storage.ErrPhotoNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		entry := exportEntry{
+			Key:           image.Key,
+			Path:          "photos/" + strings.TrimPrefix(image.Key, prefix),
+			Size:          image.Size,
+			Modified:      image.Modified,
+			PhotoMetadata: catalog[image.Key],
+			EXIF:          metadata[image.Key].EXIF,
+		}
+		// Photos are already compressed, so they are stored as they are
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: entry.Path, Method: zip.Store, Modified: image.Modified})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, body); err != nil {
+			return fmt.Errorf("error copying %s: %w", image.Key, err)
+		}
+		manifest.Photos = append(manifest.Photos, entry)
+		return nil
+	})
+	if err == nil {
+		var f io.Writer
+		if f, err = zw.Create("manifest.json"); err == nil {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(manifest)
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Error streaming export %d of user %d: %v", export.ID, userID, err)
+		// The status is already sent; breaking the connection keeps the client from taking
+		// a truncated archive for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := s.store.CompleteExport(r.Context(), export.ID); err != nil {
+		log.Printf("Error completing export %d: %v", export.ID, err)
+	}
+}
@@ -1,13 +1,45 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+
+	"github.com/alvarofc/mode/imaging"
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/types"
 )
 
 func (s *Server) handleGetPhotoByKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Only photos in the catalog are served: not the trash, derivatives, or the files of deleted
+	// accounts that are waiting for the purger
 	key := r.PathValue("key")
+	ownerID, ok := photoOwner(key)
+	if !ok {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if _, err := s.store.GetPhoto(r.Context(), ownerID, key); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error looking up photo %s: %v", key, err)
+			http.Error(w, "Error serving photo", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
 
 	// Get header data
 	contentType := r.URL.Query().Get("Image-Type")
@@ -17,28 +49,63 @@ func (s *Server) handleGetPhotoByKey(w http.ResponseWriter, r *http.Request) {
 		contentType = "image/big"
 	}
 	var photo []byte
-	var err error
 
 	switch contentType {
 	case "image/small":
 		w.Header().Set("Content-Type", "image/png")
-		photo, err = s.s3.DownloadSmallPhotoByKey(key)
+		photo, err = s.s3.DownloadSmallPhotoByKey(r.Context(), key)
 	default:
 		w.Header().Set("Content-Type", "image/png")
-		photo, err = s.s3.DownloadPhotoByKey(key)
+		photo, err = s.s3.DownloadPhotoByKey(r.Context(), key)
 	}
 
+	if errors.Is(err, storage.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error downloading photo %s: %v", key, err)
+		http.Error(w, "Error serving photo", http.StatusInternalServerError)
 		return
 	}
 
+	// Only the owner gets the original, anyone else the watermarked copy without metadata
+	if ownerID != userID {
+		var contentType string
+		photo, contentType, err = publicPhoto(photo)
+		if err != nil {
+			log.Printf("Error preparing photo %s: %v", key, err)
+			http.Error(w, "Error serving photo", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+
 	w.Write(photo)
 
 }
 
-func (s *Server) handleGetLastXPhotosForUser(w http.ResponseWriter, r *http.Request) {
+// listingRequest returns the {user_id} of a listing request, which must be the signed-in user
+// Listings hand out presigned links to the originals, so other users' libraries are reported as missing.
+func listingRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	callerID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
 	userID := r.PathValue("user_id")
+	if userID != strconv.Itoa(callerID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return "", false
+	}
+	return userID, true
+}
+
+func (s *Server) handleGetLastXPhotosForUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := listingRequest(w, r)
+	if !ok {
+		return
+	}
 	photoNum := r.URL.Query().Get("photo_num")
 	photoCount, err := strconv.ParseInt(photoNum, 10, 64)
 	if err != nil {
@@ -46,23 +113,185 @@ func (s *Server) handleGetLastXPhotosForUser(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	photos, err := s.s3.GetLastXPhotosForUser(userID, photoCount)
+	photos, err := s.s3.GetLastXPhotosForUser(r.Context(), userID, photoCount)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	images := make([]*types.ImageInfo, len(photos))
+	for i := range photos {
+		images[i] = &photos[i]
+	}
+	s.attachImageMetadata(r.Context(), ownerListingMetadata, images...)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(photos)
 }
 
 func (s *Server) handleGetLastPhotoForUser(w http.ResponseWriter, r *http.Request) {
-	userID := r.PathValue("user_id")
+	userID, ok := listingRequest(w, r)
+	if !ok {
+		return
+	}
 
-	photo, err := s.s3.GetLastPhotoForUser(userID)
+	photo, err := s.s3.GetLastPhotoForUser(r.Context(), userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.attachImageMetadata(r.Context(), ownerListingMetadata, &photo)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(photo)
 }
+
+// maxPhotoSize caps the body of photo uploads
+const maxPhotoSize = 20 << 20
+
+// photoExtensions maps the accepted upload content types to the extension of the stored key
+var photoExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// handleUploadPhoto stores the image in the request body as a new photo of the signed-in user
+func (s *Server) handleUploadPhoto(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPhotoSize))
+	if err != nil {
+		http.Error(w, "Photo is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Trust the content, not the Content-Type header the client sent
+	ext, ok := photoExtensions[http.DetectContentType(data)]
+	if !ok {
+		http.Error(w, "Unsupported image type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	name, err := randomToken(12)
+	if err != nil {
+		http.Error(w, "Error uploading photo", http.StatusInternalServerError)
+		return
+	}
+
+	// The checksum is of the upload as sent, so it matches again whether or not metadata is stripped
+	checksum := imaging.Checksum(data)
+	duplicateOf, err := s.findDuplicate(r.Context(), userID, checksum)
+	if err != nil {
+		log.Printf("Error looking for duplicates of an upload by user %d: %v", userID, err)
+	}
+	if duplicateOf != "" && duplicateRules.reject {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "duplicate photo", "duplicate_of": duplicateOf})
+		return
+	}
+	// The analysis is the only decode of the upload, and refuses images too large to decode safely
+	analysis, err := analyzePhoto(name+ext, data)
+	if err != nil {
+		http.Error(w, "Image dimensions are too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The catalog has the metadata from the analysis, so the stored copy doesn't need it
+	if s.shouldStripUpload(r.Context(), userID) {
+		if data, err = imaging.StripMetadata(data); err != nil {
+			log.Printf("Error stripping the metadata of an upload by user %d: %v", userID, err)
+			http.Error(w, "Photo can't be processed", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	photo, err := s.s3.UploadPhoto(r.Context(), strconv.Itoa(userID), name+ext, data)
+	if err != nil {
+		log.Printf("Error uploading photo for user %d: %v", userID, err)
+		http.Error(w, "Error uploading photo", http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.CreatePhoto(r.Context(), userID, photo.Key, photo.Size); err != nil {
+		log.Printf("Error adding photo %s to the catalog: %v", photo.Key, err)
+		http.Error(w, "Error uploading photo", http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.SetPhotoChecksum(r.Context(), photo.Key, checksum); err != nil {
+		log.Printf("Error saving the checksum of photo %s: %v", photo.Key, err)
+	}
+	if analysis != nil {
+		// Photos without a hash are hashed when first compared, so this isn't fatal
+		if err := s.store.SetPhotoHash(r.Context(), photo.Key, analysis.Hash); err != nil {
+			log.Printf("Error saving the hash of photo %s: %v", photo.Key, err)
+		}
+		if err := s.store.SetImageMetadata(r.Context(), photo.Key, analysis.Metadata); err != nil {
+			log.Printf("Error saving the metadata of photo %s: %v", photo.Key, err)
+		}
+		photo.ImageMetadata = analysis.Metadata
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		types.ImageInfo
+		// DuplicateOf is set when the user already has a photo with the same content
+		DuplicateOf string `json:"duplicate_of,omitempty"`
+	}{photo, duplicateOf})
+}
+
+// photoOwner returns the ID of the user whose library key is in, from its user_<id>/ prefix
+// Keys in the trash or derivatives, and non-canonical ones, which S3 would resolve elsewhere, have none.
+func photoOwner(key string) (int, bool) {
+	if !fs.ValidPath(key) || strings.HasPrefix(key, storage.TrashPrefix) || strings.HasPrefix(key, storage.DerivativesPrefix) {
+		return 0, false
+	}
+	dir, name, ok := strings.Cut(key, "/")
+	if !ok || name == "" {
+		return 0, false
+	}
+	id, ok := strings.CutPrefix(dir, "user_")
+	if !ok {
+		return 0, false
+	}
+	ownerID, err := strconv.Atoi(id)
+	return ownerID, err == nil && strconv.Itoa(ownerID) == id
+}
+
+// signedFiles is implemented by file stores that hand out links to the API instead of presigned URLs
+type signedFiles interface {
+	VerifySignedURL(key string, query url.Values) error
+}
+
+// handleGetFile serves the signed links of the local filesystem storage
+// The signature authorizes the request, so it works for plain <img> tags without a session.
+func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	files, ok := s.s3.(signedFiles)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := r.PathValue("key")
+	if err := files.VerifySignedURL(key, r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	photo, err := s.s3.DownloadPhotoByKey(r.Context(), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(photo))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(photo)
+}
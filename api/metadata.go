@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/alvarofc/mode/imaging"
+	"github.com/alvarofc/mode/types"
+)
+
+// analyzePhoto extracts the hash and metadata of an upload, or returns nil if it can't be decoded
+// Images over imaging.MaxPixels aren't decoded at all and return imaging.ErrTooLarge.
+// The catalog keeps the full EXIF data, GPS included, as the owner's private copy.
+func analyzePhoto(key string, data []byte) (*imaging.Analysis, error) {
+	analysis, err := imaging.Analyze(data)
+	if errors.Is(err, imaging.ErrTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Not analyzing photo %s: %v", key, err)
+		return nil, nil
+	}
+	return &analysis, nil
+}
+
+// metadataView is how much of the catalogued metadata a response may carry
+type metadataView int
+
+const (
+	// publicMetadata is for responses that reach anyone but the owner: the location and the
+	// device tags (camera, lens, software) are left out, and so is the type, since public copies
+	// may be re-encoded
+	publicMetadata metadataView = iota
+	// ownerListingMetadata is for the owner's listings, which leave out the location
+	ownerListingMetadata
+	// ownerMetadata is everything, for the owner's view of a single photo and their data export
+	ownerMetadata
+)
+
+// filter returns the part of meta that view may carry
+func (view metadataView) filter(meta types.ImageMetadata) types.ImageMetadata {
+	if view == publicMetadata {
+		meta.MIMEType = ""
+	}
+	if meta.EXIF == nil || view == ownerMetadata {
+		return meta
+	}
+	exif := *meta.EXIF
+	exif.GPS = nil
+	if view == publicMetadata {
+		exif.Make, exif.Model, exif.LensModel, exif.Software = "", "", "", ""
+	}
+	meta.EXIF = &exif
+	return meta
+}
+
+// attachImageMetadata fills in the catalogued metadata of images, as much as view allows
+// Listings still work without metadata, so a failed lookup is only logged.
+func (s *Server) attachImageMetadata(ctx context.Context, view metadataView, images ...*types.ImageInfo) {
+	if len(images) == 0 {
+		return
+	}
+	keys := make([]string, len(images))
+	for i, image := range images {
+		keys[i] = image.Key
+	}
+
+	metadata, err := s.store.ImageMetadata(ctx, keys)
+	if err != nil {
+		log.Printf("Error loading image metadata: %v", err)
+		return
+	}
+	for _, image := range images {
+		image.ImageMetadata = view.filter(metadata[image.Key])
+	}
+}
+
+// presignImages gives images a presigned URL and attaches their catalogued metadata, as much as view allows
+// It's shared by every response built from catalog rows; S3 listings come back presigned already.
+func (s *Server) presignImages(ctx context.Context, view metadataView, images ...*types.ImageInfo) error {
+	for _, image := range images {
+		var err error
+		image.URL, image.URLExpires, err = s.s3.PresignURL(ctx, image.Key, 0)
+		if err != nil {
+			return fmt.Errorf("error presigning %s: %w", image.Key, err)
+		}
+	}
+	s.attachImageMetadata(ctx, view, images...)
+	return nil
+}
+
+// shouldStripUpload reports whether uploads of the user are stored without their metadata
+// When the setting can't be read the metadata is stripped, the private choice.
+func (s *Server) shouldStripUpload(ctx context.Context, userID int) bool {
+	user, err := s.store.GetUserById(ctx, userID)
+	if err != nil {
+		log.Printf("Error loading the privacy settings of user %d: %v", userID, err)
+		return true
+	}
+	return user.StripMetadata
+}
+
+// handleUpdatePrivacySettings chooses whether EXIF, GPS and other metadata is removed from stored uploads
+// Shared links are always served without metadata, whatever this is set to.
+func (s *Server) handleUpdatePrivacySettings(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		StripMetadata *bool `json:"strip_metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.StripMetadata == nil {
+		writeFieldErrors(w, http.StatusBadRequest, []fieldError{{Field: "strip_metadata", Message: "is required"}})
+		return
+	}
+
+	err = s.store.SetStripMetadata(r.Context(), userID, *req.StripMetadata)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"strip_metadata": *req.StripMetadata})
+}
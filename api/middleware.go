@@ -2,9 +2,14 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -29,19 +34,29 @@ func (s *Server) loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// authMiddleware checks for a valid JWT token
+// authMiddleware checks for a valid JWT token, from the Authorization header or the mode_session cookie
 func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("mode_session")
-		if err != nil {
-			if err == http.ErrNoCookie {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		var tokenString string
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			tokenString = bearer
+		} else if credentialsInHeader(r) {
+			// Header credentials other than a session token aren't accepted here, and
+			// must not fall back to the cookie since they skip CSRF checks
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		} else {
+			c, err := r.Cookie("mode_session")
+			if err != nil {
+				if err == http.ErrNoCookie {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			tokenString = c.Value
 		}
-		tokenString := c.Value
 
 		claims := &jwt.StandardClaims{}
 		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
@@ -62,16 +77,75 @@ func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		if !token.Valid {
+		// Tokens minted for other purposes (email verification, password reset)
+		// carry an audience and must never authenticate a request
+		if !token.Valid || claims.Audience != "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Sessions aren't stored, so those of a deleted account are revoked by checking it still exists,
+		// and those issued before a password change by comparing the times below
+		userID, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		user, err := s.store.GetUserById(r.Context(), userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			log.Printf("Error looking up user %d: %v", userID, err)
+			http.Error(w, "Error authenticating request", http.StatusInternalServerError)
+			return
+		}
+
+		// A password change signs out every session issued before it. Tokens only have second
+		// precision, so sessions from the same second as the change survive it.
+		if claims.IssuedAt < user.PasswordChangedAt.Unix() {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "user", claims.Subject)
+		ctx = context.WithValue(ctx, "signed_in_at", time.Unix(claims.IssuedAt, 0))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+// metricsMiddleware only lets through requests carrying token as a bearer token
+// Monitoring scrapers have no user account, so the metrics endpoint can't use authMiddleware.
+func metricsMiddleware(token string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// recentSignIn reports whether the session of the request was issued within reauthWindow
+// Sessions from before sign-in times were recorded never count as recent.
+func recentSignIn(r *http.Request) bool {
+	signedInAt, ok := r.Context().Value("signed_in_at").(time.Time)
+	return ok && signedInAt.Unix() > 0 && time.Since(signedInAt) < reauthWindow
+}
+
+// userIDFromContext returns the ID of the user authenticated by authMiddleware
+func userIDFromContext(r *http.Request) (int, error) {
+	subject, ok := r.Context().Value("user").(string)
+	if !ok {
+		return 0, errors.New("request is not authenticated")
+	}
+	return strconv.Atoi(subject)
+}
+
 // combineMiddleware combines multiple middleware functions
 func (s *Server) combineMiddleware(handler http.HandlerFunc, middlewares ...func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
 	for _, middleware := range middlewares {
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/alvarofc/mode/oidc"
+	"github.com/alvarofc/mode/types"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	oidcCookieName   = "mode_oidc"
+	oidcLoginTTL     = 10 * time.Minute
+	oidcLoginPurpose = "oidc_login"
+)
+
+var errUnverifiedIdentityEmail = errors.New("the provider did not return a verified email address")
+
+// oidcLoginClaims carries the per-login secrets between the redirect to the provider and the callback
+type oidcLoginClaims struct {
+	jwt.StandardClaims
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.providers[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	claims := &oidcLoginClaims{Provider: provider.Name()}
+	for _, field := range []*string{&claims.State, &claims.Nonce, &claims.Verifier} {
+		v, err := oidc.RandomString(32)
+		if err != nil {
+			http.Error(w, "Error starting login", http.StatusInternalServerError)
+			return
+		}
+		*field = v
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), claims.State, claims.Nonce, oidc.CodeChallenge(claims.Verifier))
+	if err != nil {
+		log.Printf("Error starting %s login: %v", provider.Name(), err)
+		http.Error(w, "Error starting login", http.StatusBadGateway)
+		return
+	}
+
+	expirationTime := time.Now().Add(oidcLoginTTL)
+	claims.Audience = oidcLoginPurpose
+	claims.ExpiresAt = expirationTime.Unix()
+	cookieValue, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(signKey)
+	if err != nil {
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+
+	// Strict would drop the cookie: the callback is a top-level navigation from the provider's site
+	cookie := newCookie(r, oidcCookieName, cookieValue, "/auth/", expirationTime, true)
+	if cookie.SameSite == http.SameSiteStrictMode {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, cookie)
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.providers[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	c, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		http.Error(w, "Login session missing or expired", http.StatusBadRequest)
+		return
+	}
+	// The login state is single-use either way
+	expired := newCookie(r, oidcCookieName, "", "/auth/", time.Time{}, true)
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+
+	claims := &oidcLoginClaims{}
+	token, err := parseToken(c.Value, claims)
+	if err != nil || !token.Valid || !claims.VerifyAudience(oidcLoginPurpose, true) || claims.Provider != provider.Name() {
+		http.Error(w, "Login session missing or expired", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(claims.State)) != 1 {
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		http.Error(w, "Login failed: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), query.Get("code"), claims.Verifier, claims.Nonce)
+	if err != nil {
+		log.Printf("Error completing %s login: %v", provider.Name(), err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := s.userForIdentity(r.Context(), identity)
+	if err != nil {
+		if errors.Is(err, errUnverifiedIdentityEmail) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Error resolving %s identity %s: %v", identity.Provider, identity.Subject, err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+
+	// The provider stands in for the password only; accounts with 2FA still need their code. The
+	// pre-auth token goes in the fragment so it stays out of server logs and Referer headers.
+	if user.TOTPEnabled {
+		preAuthToken, err := s.issuePreAuthToken(r.Context(), user.ID)
+		if err != nil {
+			log.Printf("Error signing token: %v", err)
+			http.Error(w, "Error creating token", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, appURL(r)+"/signin/2fa#pre_auth_token="+url.QueryEscape(preAuthToken), http.StatusFound)
+		return
+	}
+
+	if _, err := s.issueSession(w, r, user); err != nil {
+		log.Printf("Error signing token: %v", err)
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, appURL(r)+"/", http.StatusFound)
+}
+
+// userForIdentity returns the user linked to identity, linking or creating one on first login
+// Linking by email only happens when the provider vouches for the address
+func (s *Server) userForIdentity(ctx context.Context, identity oidc.Identity) (types.User, error) {
+	user, err := s.store.GetUserByIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return types.User{}, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return types.User{}, errUnverifiedIdentityEmail
+	}
+	email, err := normalizeEmail(identity.Email)
+	if err != nil {
+		return types.User{}, errUnverifiedIdentityEmail
+	}
+	identity.Email = email
+
+	user, err = s.store.GetUserByEmail(ctx, identity.Email)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// Accounts created through a provider get an unusable random password;
+		// the owner can still set one through the password reset flow
+		password, err := randomToken(32)
+		if err != nil {
+			return types.User{}, err
+		}
+		if err := s.store.CreateUser(ctx, identity.Email, password); err != nil {
+			return types.User{}, err
+		}
+		if user, err = s.store.GetUserByEmail(ctx, identity.Email); err != nil {
+			return types.User{}, err
+		}
+	case err != nil:
+		return types.User{}, err
+	case !user.EmailVerified:
+		// Someone registered this address without proving they own it. The provider
+		// just did, so drop whatever password was set to keep them from riding along.
+		password, err := randomToken(32)
+		if err != nil {
+			return types.User{}, err
+		}
+		if err := s.store.UpdatePassword(ctx, user.ID, password); err != nil {
+			return types.User{}, err
+		}
+	}
+
+	if !user.EmailVerified {
+		if err := s.store.MarkEmailVerified(ctx, user.ID); err != nil {
+			return types.User{}, err
+		}
+		user.EmailVerified = true
+	}
+
+	if err := s.store.LinkIdentity(ctx, user.ID, identity.Provider, identity.Subject, identity.Email); err != nil {
+		return types.User{}, err
+	}
+
+	return user, nil
+}
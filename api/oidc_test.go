@@ -0,0 +1,236 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alvarofc/mode/oidc"
+	"github.com/alvarofc/mode/oidc/oidctest"
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const oidcTestRedirect = "http://mode.test/auth/mock/callback"
+
+// newOIDCTestServer returns a server whose only provider, "mock", logs in through a mock issuer
+func newOIDCTestServer(t *testing.T) (*Server, *storage.Memory, *oidctest.Issuer) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating the signing key: %v", err)
+	}
+	signKey, verifyKey = key, &key.PublicKey
+
+	issuer := oidctest.NewIssuer(t)
+	store := storage.NewMemory()
+	s := NewServer(":0", store, nil, nil)
+	s.providers = map[string]*oidc.Provider{"mock": oidc.NewProvider(issuer.Config("mock", oidcTestRedirect))}
+	return s, store, issuer
+}
+
+// startOIDCLogin follows GET /auth/mock/login and returns the provider URL and the login cookie
+func startOIDCLogin(t *testing.T, s *Server) (string, *http.Cookie) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/auth/mock/login", nil)
+	req.SetPathValue("provider", "mock")
+	rec := httptest.NewRecorder()
+	s.handleOIDCLogin(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login = %d %s, want a redirect", rec.Code, rec.Body)
+	}
+
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcCookieName {
+			return rec.Header().Get("Location"), c
+		}
+	}
+	t.Fatal("login did not set the login cookie")
+	return "", nil
+}
+
+// oidcCallback calls GET /auth/mock/callback with the given code and state
+func oidcCallback(s *Server, cookie *http.Cookie, code, state string) *httptest.ResponseRecorder {
+	query := url.Values{"code": {code}, "state": {state}}
+	req := httptest.NewRequest(http.MethodGet, "/auth/mock/callback?"+query.Encode(), nil)
+	req.SetPathValue("provider", "mock")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	s.handleOIDCCallback(rec, req)
+	return rec
+}
+
+// oidcLogin runs a whole login as login and returns the callback response
+func oidcLogin(t *testing.T, s *Server, issuer *oidctest.Issuer, login oidctest.Login) *httptest.ResponseRecorder {
+	t.Helper()
+	authURL, cookie := startOIDCLogin(t, s)
+	code, state := issuer.Authorize(t, authURL, login)
+	return oidcCallback(s, cookie, code, state)
+}
+
+func sessionCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "mode_session" && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestOIDCCallbackCreatesAndLinksAccount(t *testing.T) {
+	s, store, issuer := newOIDCTestServer(t)
+	ctx := context.Background()
+
+	rec := oidcLogin(t, s, issuer, oidctest.Login{Subject: "alice", Email: "Alice@Example.com", EmailVerified: true})
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "http://example.com/" || sessionCookie(rec) == nil {
+		t.Fatalf("callback = %d to %q, want a signed-in redirect to the app", rec.Code, rec.Header().Get("Location"))
+	}
+
+	user, err := store.GetUserByIdentity(ctx, "mock", "alice")
+	if err != nil {
+		t.Fatalf("GetUserByIdentity: %v", err)
+	}
+	if user.Email != "alice@example.com" || !user.EmailVerified {
+		t.Errorf("new account = %+v, want the verified, lowercased provider email", user)
+	}
+
+	// The subject identifies the account from then on, whatever the provider says the email is
+	rec = oidcLogin(t, s, issuer, oidctest.Login{Subject: "alice", Email: "alice@elsewhere.example", EmailVerified: true})
+	if rec.Code != http.StatusFound || sessionCookie(rec) == nil {
+		t.Fatalf("second login = %d %s, want a signed-in redirect", rec.Code, rec.Body)
+	}
+	if _, err := store.GetUserByEmail(ctx, "alice@elsewhere.example"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second login created an account for the new email: %v", err)
+	}
+	if identities, _ := store.ListIdentities(ctx, user.ID); len(identities) != 1 {
+		t.Errorf("identities = %+v, want the one link", identities)
+	}
+}
+
+func TestOIDCCallbackLinksExistingAccount(t *testing.T) {
+	s, store, issuer := newOIDCTestServer(t)
+	ctx := context.Background()
+
+	if err := store.CreateUser(ctx, "bob@example.com", "squatter password"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	existing, _ := store.GetUserByEmail(ctx, "bob@example.com")
+
+	rec := oidcLogin(t, s, issuer, oidctest.Login{Subject: "bob", Email: "bob@example.com", EmailVerified: true})
+	if rec.Code != http.StatusFound || sessionCookie(rec) == nil {
+		t.Fatalf("callback = %d %s, want a signed-in redirect", rec.Code, rec.Body)
+	}
+
+	user, err := store.GetUserByIdentity(ctx, "mock", "bob")
+	if err != nil || user.ID != existing.ID {
+		t.Fatalf("GetUserByIdentity = %+v, %v, want the existing account %d", user, err, existing.ID)
+	}
+	// The address was never verified, so whoever registered it loses the password they chose
+	linked, _ := store.GetUserByEmail(ctx, "bob@example.com")
+	if !linked.EmailVerified {
+		t.Error("linking through a verified provider email did not verify the account")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(linked.Password), []byte("squatter password")) == nil {
+		t.Error("the unverified account kept its password after linking")
+	}
+}
+
+func TestOIDCCallbackRejectsUnverifiedEmail(t *testing.T) {
+	s, store, issuer := newOIDCTestServer(t)
+
+	rec := oidcLogin(t, s, issuer, oidctest.Login{Subject: "carol", Email: "carol@example.com"})
+	if rec.Code != http.StatusForbidden || sessionCookie(rec) != nil {
+		t.Fatalf("callback with an unverified email = %d, want 403 without a session", rec.Code)
+	}
+	if _, err := store.GetUserByEmail(context.Background(), "carol@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("an account was created for an unverified email: %v", err)
+	}
+}
+
+func TestOIDCCallbackChecksState(t *testing.T) {
+	s, _, issuer := newOIDCTestServer(t)
+	login := oidctest.Login{Subject: "dave", Email: "dave@example.com", EmailVerified: true}
+
+	authURL, cookie := startOIDCLogin(t, s)
+	code, _ := issuer.Authorize(t, authURL, login)
+	if rec := oidcCallback(s, cookie, code, "forged"); rec.Code != http.StatusBadRequest || sessionCookie(rec) != nil {
+		t.Errorf("callback with another state = %d, want 400 without a session", rec.Code)
+	}
+
+	authURL, _ = startOIDCLogin(t, s)
+	code, state := issuer.Authorize(t, authURL, login)
+	if rec := oidcCallback(s, nil, code, state); rec.Code != http.StatusBadRequest || sessionCookie(rec) != nil {
+		t.Errorf("callback without the login cookie = %d, want 400 without a session", rec.Code)
+	}
+
+	// Another login's cookie carries another state
+	_, other := startOIDCLogin(t, s)
+	if rec := oidcCallback(s, other, code, state); rec.Code != http.StatusBadRequest || sessionCookie(rec) != nil {
+		t.Errorf("callback with another login's cookie = %d, want 400 without a session", rec.Code)
+	}
+}
+
+func TestOIDCCallbackChecksNonce(t *testing.T) {
+	s, store, issuer := newOIDCTestServer(t)
+
+	rec := oidcLogin(t, s, issuer, oidctest.Login{Subject: "erin", Email: "erin@example.com", EmailVerified: true, Nonce: "replayed"})
+	if rec.Code != http.StatusUnauthorized || sessionCookie(rec) != nil {
+		t.Fatalf("callback with an ID token for another nonce = %d, want 401 without a session", rec.Code)
+	}
+	if _, err := store.GetUserByIdentity(context.Background(), "mock", "erin"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("an identity was linked from a token with the wrong nonce: %v", err)
+	}
+}
+
+func TestOIDCCallbackRejectsReusedCode(t *testing.T) {
+	s, _, issuer := newOIDCTestServer(t)
+
+	authURL, cookie := startOIDCLogin(t, s)
+	code, state := issuer.Authorize(t, authURL, oidctest.Login{Subject: "frank", Email: "frank@example.com", EmailVerified: true})
+	if rec := oidcCallback(s, cookie, code, state); rec.Code != http.StatusFound {
+		t.Fatalf("callback = %d %s, want a redirect", rec.Code, rec.Body)
+	}
+	// The provider redeems a code only once
+	if rec := oidcCallback(s, cookie, code, state); rec.Code != http.StatusUnauthorized || sessionCookie(rec) != nil {
+		t.Errorf("replayed callback = %d, want it refused", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRequiresSecondFactor(t *testing.T) {
+	s, store, issuer := newOIDCTestServer(t)
+	ctx := context.Background()
+
+	rec := oidcLogin(t, s, issuer, oidctest.Login{Subject: "grace", Email: "grace@example.com", EmailVerified: true})
+	if rec.Code != http.StatusFound {
+		t.Fatalf("first login = %d %s", rec.Code, rec.Body)
+	}
+	user, _ := store.GetUserByIdentity(ctx, "mock", "grace")
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	if err := store.SetTOTPSecret(ctx, user.ID, secret); err != nil {
+		t.Fatalf("SetTOTPSecret: %v", err)
+	}
+	if err := store.EnableTOTP(ctx, user.ID); err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+
+	rec = oidcLogin(t, s, issuer, oidctest.Login{Subject: "grace", Email: "grace@example.com", EmailVerified: true})
+	if rec.Code != http.StatusFound || sessionCookie(rec) != nil {
+		t.Fatalf("login with 2FA = %d, want a redirect without a session", rec.Code)
+	}
+	if location := rec.Header().Get("Location"); !strings.Contains(location, "/signin/2fa#pre_auth_token=") {
+		t.Errorf("login with 2FA redirected to %q, want the second-factor page", location)
+	}
+}
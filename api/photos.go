@@ -0,0 +1,292 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/types"
+)
+
+const (
+	maxPhotoTags      = 32
+	maxTagLength      = 50
+	maxPromptLength   = 2000
+	defaultSearchSize = 20
+	maxSearchSize     = 100
+)
+
+// normalizeTags lowercases, trims and deduplicates tags, keeping their order
+func normalizeTags(tags []string) ([]string, []fieldError) {
+	seen := make(map[string]bool, len(tags))
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		switch {
+		case tag == "":
+			return nil, []fieldError{{Field: "tags", Message: "must not be empty"}}
+		case utf8.RuneCountInString(tag) > maxTagLength:
+			return nil, []fieldError{{Field: "tags", Message: fmt.Sprintf("must be at most %d characters each", maxTagLength)}}
+		case seen[tag]:
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxPhotoTags {
+		return nil, []fieldError{{Field: "tags", Message: fmt.Sprintf("must be at most %d tags", maxPhotoTags)}}
+	}
+	return normalized, nil
+}
+
+func validSource(source string) bool {
+	return source == types.PhotoSourceUpload || source == types.PhotoSourceGenerated
+}
+
+// photoRequest reads the signed-in user and a key from the path that belongs to them
+func photoRequest(w http.ResponseWriter, r *http.Request) (userID int, key string, ok bool) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, "", false
+	}
+	key = r.PathValue("key")
+	if !ownsPhoto(userID, key) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return 0, "", false
+	}
+	return userID, key, true
+}
+
+// writePhotoDetails presigns the URL of photo and writes it as JSON
+// Only owners get here, so the EXIF location is included.
+func (s *Server) writePhotoDetails(w http.ResponseWriter, r *http.Request, photo types.PhotoDetails) {
+	if err := s.presignImages(r.Context(), ownerMetadata, &photo.ImageInfo); err != nil {
+		log.Printf("Error getting photo %s: %v", photo.Key, err)
+		http.Error(w, "Error generating presigned URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(photo)
+}
+
+// handleGetPhotoMetadata returns a photo with its tags, prompt and generation parameters
+func (s *Server) handleGetPhotoMetadata(w http.ResponseWriter, r *http.Request) {
+	userID, key, ok := photoRequest(w, r)
+	if !ok {
+		return
+	}
+
+	photo, err := s.store.GetPhoto(r.Context(), userID, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.writePhotoDetails(w, r, photo)
+}
+
+// handleUpdatePhotoMetadata sets the tags, prompt, generation parameters and source of a photo;
+// omitted fields are left unchanged
+func (s *Server) handleUpdatePhotoMetadata(w http.ResponseWriter, r *http.Request) {
+	userID, key, ok := photoRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Source           *string                 `json:"source"`
+		Prompt           *string                 `json:"prompt"`
+		GenerationParams *map[string]interface{} `json:"generation_params"`
+		Tags             *[]string               `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	photo, err := s.store.GetPhoto(r.Context(), userID, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var errs []fieldError
+	if req.Source != nil {
+		if !validSource(*req.Source) {
+			errs = append(errs, fieldError{Field: "source", Message: fmt.Sprintf("must be %q or %q", types.PhotoSourceUpload, types.PhotoSourceGenerated)})
+		}
+		photo.Source = *req.Source
+	}
+	if req.Prompt != nil {
+		if utf8.RuneCountInString(*req.Prompt) > maxPromptLength {
+			errs = append(errs, fieldError{Field: "prompt", Message: fmt.Sprintf("must be at most %d characters", maxPromptLength)})
+		}
+		photo.Prompt = strings.TrimSpace(*req.Prompt)
+	}
+	if req.GenerationParams != nil {
+		photo.GenerationParams = *req.GenerationParams
+	}
+	if req.Tags != nil {
+		tags, tagErrs := normalizeTags(*req.Tags)
+		errs = append(errs, tagErrs...)
+		photo.Tags = tags
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	err = s.store.UpdatePhotoMetadata(r.Context(), userID, key, photo.PhotoMetadata)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating metadata of photo %s: %v", key, err)
+		http.Error(w, "Error updating photo", http.StatusInternalServerError)
+		return
+	}
+
+	s.writePhotoDetails(w, r, photo)
+}
+
+// parseSearchTime accepts an RFC 3339 timestamp or a plain date
+func parseSearchTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+// photoQuery reads the search parameters from the query string
+func photoQuery(r *http.Request) (storage.PhotoQuery, []fieldError) {
+	values := r.URL.Query()
+	query := storage.PhotoQuery{
+		Text:   strings.TrimSpace(values.Get("q")),
+		Source: values.Get("source"),
+		Limit:  defaultSearchSize,
+	}
+	var errs []fieldError
+
+	if values.Has("tag") {
+		tags, tagErrs := normalizeTags(values["tag"])
+		errs = append(errs, tagErrs...)
+		query.Tags = tags
+	}
+	if query.Source != "" && !validSource(query.Source) {
+		errs = append(errs, fieldError{Field: "source", Message: fmt.Sprintf("must be %q or %q", types.PhotoSourceUpload, types.PhotoSourceGenerated)})
+	}
+
+	for _, param := range []struct {
+		field string
+		dest  *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		if v := values.Get(param.field); v != "" {
+			t, err := parseSearchTime(v)
+			if err != nil {
+				errs = append(errs, fieldError{Field: param.field, Message: "must be a date such as 2024-05-01 or an RFC 3339 time"})
+			}
+			*param.dest = t
+		}
+	}
+
+	for _, param := range []struct {
+		field string
+		dest  *int64
+	}{{"min_size", &query.MinSize}, {"max_size", &query.MaxSize}} {
+		if v := values.Get(param.field); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				errs = append(errs, fieldError{Field: param.field, Message: "must be a number of bytes"})
+			}
+			*param.dest = n
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchSize {
+			errs = append(errs, fieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxSearchSize)})
+		}
+		query.Limit = n
+	}
+	if v := values.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs = append(errs, fieldError{Field: "offset", Message: "must be a non-negative number"})
+		}
+		query.Offset = n
+	}
+
+	return query, errs
+}
+
+// handleSearchPhotos finds the user's photos by tags and prompt, best matches first
+// The response carries next_offset to fetch the following page, or null on the last one.
+func (s *Server) handleSearchPhotos(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query, errs := photoQuery(r)
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	// Ask for one more to know whether there is another page
+	limit := query.Limit
+	query.Limit++
+	photos, err := s.store.SearchPhotos(r.Context(), userID, query)
+	if err != nil {
+		log.Printf("Error searching photos of user %d: %v", userID, err)
+		http.Error(w, "Error searching photos", http.StatusInternalServerError)
+		return
+	}
+
+	var nextOffset *int
+	if len(photos) > limit {
+		photos = photos[:limit]
+		next := query.Offset + limit
+		nextOffset = &next
+	}
+	if photos == nil {
+		photos = []types.PhotoDetails{}
+	}
+
+	images := make([]*types.ImageInfo, len(photos))
+	for i := range photos {
+		images[i] = &photos[i].ImageInfo
+	}
+	if err := s.presignImages(r.Context(), ownerListingMetadata, images...); err != nil {
+		log.Printf("Error searching photos of user %d: %v", userID, err)
+		http.Error(w, "Error generating presigned URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":     photos,
+		"next_offset": nextOffset,
+	})
+}
@@ -1,9 +1,14 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"net/http"
+	"os"
 
+	"github.com/alvarofc/mode/mailer"
+	"github.com/alvarofc/mode/oidc"
 	"github.com/alvarofc/mode/storage"
 )
 
@@ -11,13 +16,19 @@ type Server struct {
 	listenAddr string
 	store      storage.Storage
 	s3         storage.S3
+	mailer     mailer.Mailer
+	providers  map[string]*oidc.Provider
+	logins     *loginLimiter
 }
 
-func NewServer(listenAddr string, pg storage.Storage, s3 storage.S3) *Server {
+func NewServer(listenAddr string, pg storage.Storage, s3 storage.S3, mail mailer.Mailer) *Server {
 	return &Server{
 		listenAddr: listenAddr,
 		store:      pg,
 		s3:         s3,
+		mailer:     mail,
+		providers:  oidc.ProvidersFromEnv(),
+		logins:     newLoginLimiter(),
 	}
 }
 
@@ -25,18 +36,65 @@ func (s *Server) Start() error {
 	// Routes that only need logging
 	http.HandleFunc("POST /signup", s.loggingMiddleware(s.handleSignUp))
 	http.HandleFunc("POST /signin", s.loggingMiddleware(s.handleSignIn))
+	http.HandleFunc("POST /signin/2fa", s.loggingMiddleware(s.handleSignInTOTP))
+	http.HandleFunc("POST /verify-email", s.loggingMiddleware(s.handleVerifyEmail))
+	http.HandleFunc("POST /password/forgot", s.loggingMiddleware(s.handleForgotPassword))
+	http.HandleFunc("POST /password/reset", s.loggingMiddleware(s.handleResetPassword))
+	http.HandleFunc("GET /auth/{provider}/login", s.loggingMiddleware(s.handleOIDCLogin))
+	http.HandleFunc("GET /auth/{provider}/callback", s.loggingMiddleware(s.handleOIDCCallback))
+	http.HandleFunc("GET /files/{key...}", s.loggingMiddleware(s.handleGetFile))
+	http.HandleFunc("GET /s/{slug}", s.loggingMiddleware(s.handleGetShare))
+	http.HandleFunc("GET /s/{slug}/photos/{key}", s.loggingMiddleware(s.handleGetSharedAlbumPhoto))
+	http.HandleFunc("POST /s/{slug}/unlock", s.loggingMiddleware(s.handleUnlockShare))
+
+	// Metrics are only served, to scrapers holding the token, when one is configured
+	if token := os.Getenv("METRICS_TOKEN"); token != "" {
+		http.HandleFunc("GET /metrics", s.combineMiddleware(s.handleMetrics, s.loggingMiddleware, metricsMiddleware(token)))
+	}
 
 	// Routes that need both logging and authentication
 	http.HandleFunc("GET /user", s.combineMiddleware(s.handleGetUserById, s.loggingMiddleware, s.authMiddleware))
 	http.HandleFunc("GET /photo/{key}", s.combineMiddleware(s.handleGetPhotoByKey, s.loggingMiddleware, s.authMiddleware))
 	http.HandleFunc("GET /user/{user_id}/photos", s.combineMiddleware(s.handleGetLastXPhotosForUser, s.loggingMiddleware, s.authMiddleware))
 	http.HandleFunc("GET /user/{user_id}/photo", s.combineMiddleware(s.handleGetLastPhotoForUser, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /photo/{key}/metadata", s.combineMiddleware(s.handleGetPhotoMetadata, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /photos/{key}/similar", s.combineMiddleware(s.handleSimilarPhotos, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /photos/search", s.combineMiddleware(s.handleSearchPhotos, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /user/data", s.combineMiddleware(s.handleGetPersonalData, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /shares", s.combineMiddleware(s.handleListShares, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /export/{export_id}", s.combineMiddleware(s.handleDownloadExport, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /trash", s.combineMiddleware(s.handleListTrash, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /albums", s.combineMiddleware(s.handleListAlbums, s.loggingMiddleware, s.authMiddleware))
+	http.HandleFunc("GET /albums/{album_id}", s.combineMiddleware(s.handleGetAlbum, s.loggingMiddleware, s.authMiddleware))
+
+	// State-changing routes authenticated by cookie also need a CSRF token
+	http.HandleFunc("POST /2fa/enroll", s.combineMiddleware(s.handleEnrollTOTP, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("POST /photo", s.combineMiddleware(s.handleUploadPhoto, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("DELETE /photo/{key}", s.combineMiddleware(s.handleDeletePhoto, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("PATCH /photo/{key}", s.combineMiddleware(s.handleUpdatePhotoMetadata, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("POST /trash/{key}/restore", s.combineMiddleware(s.handleRestorePhoto, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("POST /albums", s.combineMiddleware(s.handleCreateAlbum, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("PATCH /albums/{album_id}", s.combineMiddleware(s.handleUpdateAlbum, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("DELETE /albums/{album_id}", s.combineMiddleware(s.handleDeleteAlbum, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("POST /albums/{album_id}/photos", s.combineMiddleware(s.handleAddAlbumPhotos, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("PUT /albums/{album_id}/photos", s.combineMiddleware(s.handleReorderAlbumPhotos, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("DELETE /albums/{album_id}/photos/{key}", s.combineMiddleware(s.handleRemoveAlbumPhoto, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("POST /shares", s.combineMiddleware(s.handleCreateShare, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("DELETE /shares/{share_id}", s.combineMiddleware(s.handleDeleteShare, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("POST /export", s.combineMiddleware(s.handleCreateExport, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("DELETE /user", s.combineMiddleware(s.handleDeleteUser, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("PATCH /user/privacy", s.combineMiddleware(s.handleUpdatePrivacySettings, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("POST /2fa/confirm", s.combineMiddleware(s.handleConfirmTOTP, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
+	http.HandleFunc("POST /2fa/disable", s.combineMiddleware(s.handleDisableTOTP, s.loggingMiddleware, s.csrfMiddleware, s.authMiddleware))
 
-	return http.ListenAndServe(s.listenAddr, nil)
+	go s.runTrashPurger(context.Background())
+	go s.runAccountPurger(context.Background())
+
+	return http.ListenAndServe(s.listenAddr, s.corsMiddleware(http.DefaultServeMux.ServeHTTP))
 }
 
 func (s *Server) handleGetUserById(w http.ResponseWriter, r *http.Request) {
-	user, err := s.store.GetUserById(10)
+	user, err := s.store.GetUserById(r.Context(), 10)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -44,3 +102,19 @@ func (s *Server) handleGetUserById(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(user)
 }
+
+// handleMetrics reports runtime statistics of the backing services for monitoring
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := make(map[string]interface{})
+	if pool, ok := s.store.(interface{ Stats() sql.DBStats }); ok {
+		metrics["db"] = pool.Stats()
+	}
+	if files, ok := s.s3.(interface {
+		CoalescingStats() map[string]storage.CallStats
+	}); ok {
+		metrics["coalescing"] = files.CoalescingStats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
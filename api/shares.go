@@ -0,0 +1,393 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/types"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	shareCookieName = "mode_share"
+	// shareAccessTTL is how long an unlocked password-protected share stays unlocked
+	shareAccessTTL = 24 * time.Hour
+	// bcrypt ignores anything past 72 bytes
+	maxSharePasswordLength = 72
+)
+
+// shareResponse adds what the owner of a share needs to know but the storage doesn't keep
+type shareResponse struct {
+	types.Share
+	PasswordProtected bool `json:"password_protected"`
+}
+
+func newShareResponse(r *http.Request, share types.Share) shareResponse {
+	share.URL = requestOrigin(r) + "/s/" + share.Slug
+	return shareResponse{Share: share, PasswordProtected: share.Protected()}
+}
+
+// shareAudience is the audience of tokens that unlock the share with the given slug
+func shareAudience(slug string) string {
+	return "share:" + slug
+}
+
+func (s *Server) handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		PhotoKey     string     `json:"photo_key"`
+		AlbumID      int        `json:"album_id"`
+		Password     string     `json:"password"`
+		ExpiresAt    *time.Time `json:"expires_at"`
+		MaxDownloads int        `json:"max_downloads"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var errs []fieldError
+	switch {
+	case (req.PhotoKey == "") == (req.AlbumID == 0):
+		errs = append(errs, fieldError{Field: "photo_key", Message: "either photo_key or album_id is required"})
+	case req.PhotoKey != "":
+		// Links are public, so the photo must be in the user's catalog, not merely look like their key
+		if _, err := s.store.GetPhoto(r.Context(), userID, req.PhotoKey); errors.Is(err, sql.ErrNoRows) || !ownsPhoto(userID, req.PhotoKey) {
+			errs = append(errs, fieldError{Field: "photo_key", Message: "is not one of your photos"})
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		if _, err := s.store.GetAlbum(r.Context(), userID, req.AlbumID); errors.Is(err, sql.ErrNoRows) {
+			errs = append(errs, fieldError{Field: "album_id", Message: "is not one of your albums"})
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(req.Password) > maxSharePasswordLength {
+		errs = append(errs, fieldError{Field: "password", Message: fmt.Sprintf("must be at most %d bytes", maxSharePasswordLength)})
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		errs = append(errs, fieldError{Field: "expires_at", Message: "must be in the future"})
+	}
+	if req.MaxDownloads < 0 {
+		errs = append(errs, fieldError{Field: "max_downloads", Message: "must not be negative"})
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	slug, err := randomToken(12)
+	if err != nil {
+		http.Error(w, "Error creating share", http.StatusInternalServerError)
+		return
+	}
+	share := types.Share{
+		Slug:         slug,
+		UserID:       userID,
+		PhotoKey:     req.PhotoKey,
+		AlbumID:      req.AlbumID,
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Error creating share", http.StatusInternalServerError)
+			return
+		}
+		share.PasswordHash = string(hash)
+	}
+
+	share, err = s.store.CreateShare(r.Context(), share)
+	if err != nil {
+		log.Printf("Error creating share for user %d: %v", userID, err)
+		http.Error(w, "Error creating share", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newShareResponse(r, share))
+}
+
+func (s *Server) handleListShares(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	shares, err := s.store.ListShares(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]shareResponse, len(shares))
+	for i, share := range shares {
+		resp[i] = newShareResponse(r, share)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleDeleteShare revokes a share link immediately
+func (s *Server) handleDeleteShare(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	shareID, err := strconv.Atoi(r.PathValue("share_id"))
+	if err != nil {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+
+	err = s.store.DeleteShare(r.Context(), userID, shareID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadShare looks up the share of the request and writes an error if it can't be used
+// Expired shares are gone (410). Password-protected ones need the cookie set by /s/{slug}/unlock.
+func (s *Server) loadShare(w http.ResponseWriter, r *http.Request, checkPassword bool) (types.Share, bool) {
+	share, err := s.store.GetShare(r.Context(), r.PathValue("slug"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return share, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return share, false
+	}
+	if share.Expired(time.Now()) {
+		http.Error(w, "Share has expired", http.StatusGone)
+		return share, false
+	}
+
+	if checkPassword && share.Protected() && !shareUnlocked(r, share) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"password_required": true})
+		return share, false
+	}
+
+	// Shared content must not linger in caches once the share is revoked
+	w.Header().Set("Cache-Control", "private, no-store")
+	return share, true
+}
+
+// shareUnlocked reports whether the request carries a valid unlock token for share
+func shareUnlocked(r *http.Request, share types.Share) bool {
+	c, err := r.Cookie(shareCookieName)
+	if err != nil {
+		return false
+	}
+	claims := &jwt.StandardClaims{}
+	token, err := parseToken(c.Value, claims)
+	return err == nil && token.Valid && claims.VerifyAudience(shareAudience(share.Slug), true) &&
+		claims.Subject == strconv.Itoa(share.ID)
+}
+
+// handleUnlockShare checks the password of a share and sets a cookie, scoped to the share,
+// that lets the browser view it
+func (s *Server) handleUnlockShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.loadShare(w, r, false)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !share.Protected() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Share passwords get the same brute-force protection as accounts
+	shareKey, ipKey := shareAudience(share.Slug), loginIPKey(clientIP(r))
+	if wait := s.logins.retryAfter(shareKey, ipKey); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(req.Password)); err != nil {
+		s.logins.fail(shareKey, ipKey)
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+	s.logins.succeed(shareKey)
+
+	expires := time.Now().Add(shareAccessTTL)
+	if share.ExpiresAt != nil && share.ExpiresAt.Before(expires) {
+		expires = *share.ExpiresAt
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, &jwt.StandardClaims{
+		Audience:  shareAudience(share.Slug),
+		ExpiresAt: expires.Unix(),
+		Subject:   strconv.Itoa(share.ID),
+	}).SignedString(signKey)
+	if err != nil {
+		log.Printf("Error signing token: %v", err)
+		http.Error(w, "Error unlocking share", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, newCookie(r, shareCookieName, token, "/s/"+share.Slug, expires, true))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetShare serves a shared photo, or lists the photos of a shared album with links to each
+func (s *Server) handleGetShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.loadShare(w, r, true)
+	if !ok {
+		return
+	}
+
+	if err := s.store.RecordShareView(r.Context(), share.ID); err != nil {
+		log.Printf("Error recording a view of share %d: %v", share.ID, err)
+	}
+
+	if share.PhotoKey != "" {
+		s.serveSharedPhoto(w, r, share, share.PhotoKey)
+		return
+	}
+
+	album, err := s.store.GetAlbum(r.Context(), share.UserID, share.AlbumID)
+	if err != nil {
+		writeAlbumError(w, share.AlbumID, err)
+		return
+	}
+	photos, err := s.store.AlbumPhotos(r.Context(), share.UserID, share.AlbumID)
+	if err != nil {
+		writeAlbumError(w, share.AlbumID, err)
+		return
+	}
+
+	type sharedPhoto struct {
+		Key  string `json:"key"`
+		URL  string `json:"url"`
+		Size int64  `json:"size"`
+		types.ImageMetadata
+	}
+	images := make([]*types.ImageInfo, len(photos))
+	for i := range photos {
+		images[i] = &photos[i]
+	}
+	// Visitors aren't the owner, so they get no location or device tags
+	s.attachImageMetadata(r.Context(), publicMetadata, images...)
+
+	resp := make([]sharedPhoto, len(photos))
+	for i, photo := range photos {
+		resp[i] = sharedPhoto{
+			Key:           photo.Key,
+			URL:           "/s/" + share.Slug + "/photos/" + url.PathEscape(photo.Key),
+			Size:          photo.Size,
+			ImageMetadata: photo.ImageMetadata,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":   album.Name,
+		"photos": resp,
+	})
+}
+
+// handleGetSharedAlbumPhoto serves one photo of a shared album
+func (s *Server) handleGetSharedAlbumPhoto(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.loadShare(w, r, true)
+	if !ok {
+		return
+	}
+	if share.AlbumID == 0 {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	key := r.PathValue("key")
+	photos, err := s.store.AlbumPhotos(r.Context(), share.UserID, share.AlbumID)
+	if err != nil {
+		writeAlbumError(w, share.AlbumID, err)
+		return
+	}
+	for _, photo := range photos {
+		if photo.Key == key {
+			s.serveSharedPhoto(w, r, share, key)
+			return
+		}
+	}
+	http.Error(w, "Photo not found", http.StatusNotFound)
+}
+
+// serveSharedPhoto counts a download against the share's limit and streams the photo
+func (s *Server) serveSharedPhoto(w http.ResponseWriter, r *http.Request, share types.Share, key string) {
+	// Spares the download of a photo that can't be served; RecordShareDownload has the final word
+	if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		http.Error(w, "Share has reached its download limit", http.StatusGone)
+		return
+	}
+
+	photo, err := s.s3.DownloadPhotoByKey(r.Context(), key)
+	if err != nil {
+		log.Printf("Error downloading shared photo %s: %v", key, err)
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	// The owner may keep metadata in their own copy, but it never leaves through a share, and the
+	// watermark is stamped on everything that does
+	photo, contentType, err := publicPhoto(photo)
+	if err != nil {
+		log.Printf("Error preparing shared photo %s: %v", key, err)
+		http.Error(w, "Error serving photo", http.StatusInternalServerError)
+		return
+	}
+
+	// Only a photo that can be served counts against the download limit
+	err = s.store.RecordShareDownload(r.Context(), share.ID)
+	if errors.Is(err, storage.ErrShareExhausted) {
+		http.Error(w, "Share has reached its download limit", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(photo)))
+	w.Write(photo)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/alvarofc/mode/imaging"
+	"github.com/alvarofc/mode/types"
+)
+
+// duplicatePolicy controls what happens to uploads that look like photos the user already has
+type duplicatePolicy struct {
+	// reject refuses byte-identical uploads instead of only flagging them in the response
+	reject bool
+	// threshold is the default Hamming distance under which photos count as similar
+	threshold int
+}
+
+var duplicateRules = &duplicatePolicy{threshold: 10}
+
+// InitializeDuplicatePolicy loads DUPLICATE_UPLOADS (flag or reject) and SIMILARITY_THRESHOLD (10 bits)
+func InitializeDuplicatePolicy() error {
+	policy := &duplicatePolicy{threshold: 10}
+
+	switch v := os.Getenv("DUPLICATE_UPLOADS"); v {
+	case "", "flag":
+	case "reject":
+		policy.reject = true
+	default:
+		return fmt.Errorf("DUPLICATE_UPLOADS must be flag or reject, got %q", v)
+	}
+	if v := os.Getenv("SIMILARITY_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 64 {
+			return fmt.Errorf("SIMILARITY_THRESHOLD must be a number of bits between 0 and 64, got %q", v)
+		}
+		policy.threshold = n
+	}
+
+	duplicateRules = policy
+	return nil
+}
+
+// photoHash computes the perceptual hash of an image, or returns nil if it can't be decoded
+func photoHash(key string, data []byte) *uint64 {
+	img, _, err := imaging.Decode(data)
+	if err != nil {
+		log.Printf("Not hashing photo %s: %v", key, err)
+		return nil
+	}
+	hash := imaging.DHash(img)
+	return &hash
+}
+
+// findDuplicate returns the key of a photo of the user with the same content, if any
+// Unrelated images can share a perceptual hash, so only the checksum decides what a duplicate is.
+func (s *Server) findDuplicate(ctx context.Context, userID int, checksum string) (string, error) {
+	key, err := s.store.PhotoWithChecksum(ctx, userID, checksum)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return key, err
+}
+
+// handleSimilarPhotos lists the user's photos that look like the given one, closest first
+// Only uploads are hashed when stored. Nothing stores generated images yet, so any photo
+// without a hash, such as those catalogued before hashes existed, is hashed on first use.
+func (s *Server) handleSimilarPhotos(w http.ResponseWriter, r *http.Request) {
+	userID, key, ok := photoRequest(w, r)
+	if !ok {
+		return
+	}
+
+	maxDistance, limit := duplicateRules.threshold, defaultSearchSize
+	var errs []fieldError
+	if v := r.URL.Query().Get("max_distance"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 64 {
+			errs = append(errs, fieldError{Field: "max_distance", Message: "must be a number of bits between 0 and 64"})
+		}
+		maxDistance = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchSize {
+			errs = append(errs, fieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxSearchSize)})
+		}
+		limit = n
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	photo, err := s.store.GetPhoto(r.Context(), userID, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting photo %s: %v", key, err)
+		http.Error(w, "Error finding similar photos", http.StatusInternalServerError)
+		return
+	}
+
+	if photo.Hash == nil {
+		data, err := s.s3.DownloadPhotoByKey(r.Context(), key)
+		if err != nil {
+			log.Printf("Error downloading photo %s to hash it: %v", key, err)
+			http.Error(w, "Error finding similar photos", http.StatusInternalServerError)
+			return
+		}
+		if photo.Hash = photoHash(key, data); photo.Hash == nil {
+			http.Error(w, "Photo can't be decoded", http.StatusUnprocessableEntity)
+			return
+		}
+		if err := s.store.SetPhotoHash(r.Context(), key, *photo.Hash); err != nil {
+			log.Printf("Error saving the hash of photo %s: %v", key, err)
+		}
+	}
+
+	// One more, since the photo itself is always found
+	similar, err := s.store.SimilarPhotos(r.Context(), userID, *photo.Hash, maxDistance, limit+1)
+	if err != nil {
+		log.Printf("Error finding photos similar to %s: %v", key, err)
+		http.Error(w, "Error finding similar photos", http.StatusInternalServerError)
+		return
+	}
+	photos := []types.SimilarPhoto{}
+	for _, p := range similar {
+		if p.Key != key && len(photos) < limit {
+			photos = append(photos, p)
+		}
+	}
+
+	images := make([]*types.ImageInfo, len(photos))
+	for i := range photos {
+		images[i] = &photos[i].ImageInfo
+	}
+	if err := s.presignImages(r.Context(), ownerListingMetadata, images...); err != nil {
+		log.Printf("Error listing photos similar to %s: %v", key, err)
+		http.Error(w, "Error generating presigned URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(photos)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Failures allowed before lockouts kick in. IPs get more room since
+	// several users can share one address (offices, carrier NAT).
+	loginFreeFailuresPerEmail = 5
+	loginFreeFailuresPerIP    = 20
+
+	loginBaseLockout = 30 * time.Second
+	loginMaxLockout  = 1 * time.Hour
+	// Failure counts are forgotten after this long without attempts
+	loginAttemptWindow = 24 * time.Hour
+)
+
+// dummyPasswordHash is compared against when the email is unknown, so a failed
+// sign-in takes as long whether or not the account exists
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("mode-dummy-password"), bcrypt.DefaultCost)
+
+type loginAttempts struct {
+	failures    int
+	lockedUntil time.Time
+}
+
+// loginLimiter tracks failed sign-ins per email and per IP and applies
+// exponentially growing lockouts once the free failures are used up
+// Counts are kept in process memory, so each replica behind a load balancer
+// enforces its own limits and a restart forgets them.
+type loginLimiter struct {
+	mu       sync.Mutex
+	attempts *cache.Cache
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		attempts: cache.New(loginAttemptWindow, 10*time.Minute),
+	}
+}
+
+// loginEmailKey keys the failures of an address as GetUserByEmail matches it, ignoring case
+// Callers pass the address they look the user up with, normalized when it's valid.
+func loginEmailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func freeFailures(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return loginFreeFailuresPerIP
+	}
+	return loginFreeFailuresPerEmail
+}
+
+// retryAfter returns how long the caller must wait before any of keys may try again
+func (l *loginLimiter) retryAfter(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		if v, found := l.attempts.Get(key); found {
+			if d := time.Until(v.(loginAttempts).lockedUntil); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt against every key
+func (l *loginLimiter) fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		var a loginAttempts
+		if v, found := l.attempts.Get(key); found {
+			a = v.(loginAttempts)
+		}
+		a.failures++
+
+		if over := a.failures - freeFailures(key); over > 0 {
+			lockout := loginBaseLockout * time.Duration(math.Pow(2, float64(over-1)))
+			if lockout > loginMaxLockout || lockout <= 0 {
+				lockout = loginMaxLockout
+			}
+			a.lockedUntil = time.Now().Add(lockout)
+			log.Printf("Sign-in lockout: %s locked for %v after %d failed attempts", key, lockout, a.failures)
+		}
+
+		l.attempts.Set(key, a, cache.DefaultExpiration)
+	}
+}
+
+// succeed clears the failure count for key
+func (l *loginLimiter) succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attempts.Delete(key)
+}
+
+// tooManyAttempts writes a 429 telling the client when to come back
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+}
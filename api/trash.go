@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alvarofc/mode/storage"
+)
+
+// trashPolicy controls how long deleted photos can be restored
+type trashPolicy struct {
+	retention time.Duration
+	// interval is how often the purger looks for expired photos
+	interval time.Duration
+}
+
+var trashRules = &trashPolicy{retention: 30 * 24 * time.Hour, interval: time.Hour}
+
+// InitializeTrashPolicy loads TRASH_RETENTION (30 days by default) and TRASH_PURGE_INTERVAL (1h)
+func InitializeTrashPolicy() error {
+	policy := &trashPolicy{retention: 30 * 24 * time.Hour, interval: time.Hour}
+
+	if v := os.Getenv("TRASH_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("TRASH_RETENTION must be a duration such as 720h, got %q", v)
+		}
+		policy.retention = d
+	}
+	if v := os.Getenv("TRASH_PURGE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("TRASH_PURGE_INTERVAL must be a positive duration, got %q", v)
+		}
+		policy.interval = d
+	}
+
+	trashRules = policy
+	return nil
+}
+
+// ownsPhoto reports whether key is stored under the user's prefix
+// The key must be canonical: S3 resolves "." and ".." segments, so user_1/../user_2/x.png would
+// name another user's photo.
+func ownsPhoto(userID int, key string) bool {
+	return fs.ValidPath(key) && strings.HasPrefix(key, fmt.Sprintf("user_%d/", userID))
+}
+
+// handleDeletePhoto moves a photo to the trash, from where it can be restored until it is purged
+func (s *Server) handleDeletePhoto(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := r.PathValue("key")
+	if !ownsPhoto(userID, key) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	err = s.s3.TrashPhoto(r.Context(), strconv.Itoa(userID), key)
+	if errors.Is(err, storage.ErrPhotoNotFound) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error trashing photo %s: %v", key, err)
+		http.Error(w, "Error deleting photo", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.store.TrashPhoto(r.Context(), userID, key); err != nil {
+		// Put the object back, otherwise the purger would never find it
+		log.Printf("Error marking photo %s as deleted: %v", key, err)
+		if err := s.s3.RestorePhoto(context.WithoutCancel(r.Context()), strconv.Itoa(userID), key); err != nil {
+			log.Printf("Error restoring photo %s after a failed delete: %v", key, err)
+		}
+		http.Error(w, "Error deleting photo", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListTrash returns the signed-in user's deleted photos and when they will be purged
+func (s *Server) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	photos, err := s.store.ListTrash(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range photos {
+		photos[i].PurgeAt = photos[i].DeletedAt.Add(trashRules.retention)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(photos)
+}
+
+// handleRestorePhoto moves a photo out of the trash
+func (s *Server) handleRestorePhoto(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := r.PathValue("key")
+	if !ownsPhoto(userID, key) {
+		http.Error(w, "Photo not found in trash", http.StatusNotFound)
+		return
+	}
+
+	err = s.store.RestorePhoto(r.Context(), userID, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Photo not found in trash", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.s3.RestorePhoto(r.Context(), strconv.Itoa(userID), key); err != nil {
+		log.Printf("Error restoring photo %s: %v", key, err)
+		if err := s.store.TrashPhoto(context.WithoutCancel(r.Context()), userID, key); err != nil {
+			log.Printf("Error marking photo %s as deleted again: %v", key, err)
+		}
+		http.Error(w, "Error restoring photo", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runTrashPurger purges expired photos every trashRules.interval until ctx ends
+func (s *Server) runTrashPurger(ctx context.Context) {
+	ticker := time.NewTicker(trashRules.interval)
+	defer ticker.Stop()
+
+	for {
+		if purged, err := s.purgeTrash(ctx); err != nil {
+			log.Printf("Error purging trash: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d photos from the trash", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTrash permanently deletes the photos that have been in the trash longer than the retention period
+// Catalog entries are only removed once their objects are gone, so failures are retried on the next run.
+func (s *Server) purgeTrash(ctx context.Context) (int, error) {
+	const batchSize = 100
+
+	purged := 0
+	for {
+		photos, err := s.store.ExpiredTrash(ctx, time.Now().Add(-trashRules.retention), batchSize)
+		if err != nil {
+			return purged, err
+		}
+
+		for _, photo := range photos {
+			if err := s.s3.PurgePhoto(ctx, photo.Key); err != nil {
+				return purged, fmt.Errorf("purging %s: %w", photo.Key, err)
+			}
+			if err := s.store.DeletePhoto(ctx, photo.Key); err != nil {
+				return purged, fmt.Errorf("deleting %s from the catalog: %w", photo.Key, err)
+			}
+			purged++
+		}
+
+		if len(photos) < batchSize {
+			return purged, nil
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alvarofc/mode/totp"
+	"github.com/alvarofc/mode/types"
+)
+
+const (
+	// preAuthPurpose is the audience of tokens proving the password step of a 2FA sign-in
+	preAuthPurpose  = "2fa"
+	preAuthTokenTTL = 5 * time.Minute
+
+	totpIssuer        = "Mode"
+	recoveryCodeCount = 10
+)
+
+// issuePreAuthToken returns a short-lived, single-use token that only /signin/2fa accepts
+func (s *Server) issuePreAuthToken(ctx context.Context, userID int) (string, error) {
+	return s.issueAccountToken(ctx, userID, preAuthPurpose, preAuthTokenTTL)
+}
+
+var (
+	errSecondFactorRequired = errors.New("a code or recovery code is required")
+	errInvalidSecondFactor  = errors.New("invalid code")
+)
+
+// useTOTPCode checks a TOTP code and records its time step, so each code is only accepted once
+func (s *Server) useTOTPCode(ctx context.Context, user types.User, code string) error {
+	step, ok := totp.ValidateStep(code, user.TOTPSecret, time.Now())
+	if !ok {
+		return errInvalidSecondFactor
+	}
+	err := s.store.UseTOTPStep(ctx, user.ID, step)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errInvalidSecondFactor
+	}
+	return err
+}
+
+// verifySecondFactor checks the TOTP code, or the recovery code when there is none, of a user with 2FA
+func (s *Server) verifySecondFactor(ctx context.Context, user types.User, code, recoveryCode string) error {
+	switch {
+	case code != "":
+		return s.useTOTPCode(ctx, user, code)
+	case recoveryCode != "":
+		err := s.store.UseRecoveryCode(ctx, user.ID, hashToken(normalizeRecoveryCode(recoveryCode)))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errInvalidSecondFactor
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("User %d used a recovery code", user.ID)
+		return nil
+	}
+	return errSecondFactorRequired
+}
+
+// normalizeRecoveryCode lets users type codes with or without the dash and in any case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// generateRecoveryCodes returns the codes to show the user once and the hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		var b strings.Builder
+		for j := 0; j < 10; j++ {
+			if j == 5 {
+				b.WriteByte('-')
+			}
+			b.WriteByte(alphabet[int(raw[j])%len(alphabet)])
+		}
+		codes[i] = b.String()
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+func (s *Server) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := s.store.GetUserById(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error getting user %d: %v", userID, err)
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.SetTOTPSecret(r.Context(), userID, secret); err != nil {
+		log.Printf("Error storing TOTP secret for user %d: %v", userID, err)
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(totpIssuer, user.Email, secret),
+	})
+}
+
+func (s *Server) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.store.GetUserById(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error getting user %d: %v", userID, err)
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Two-factor enrollment has not been started", http.StatusBadRequest)
+		return
+	}
+	if err := s.useTOTPCode(r.Context(), user, req.Code); err != nil {
+		if !errors.Is(err, errInvalidSecondFactor) {
+			log.Printf("Error recording the TOTP code of user %d: %v", userID, err)
+		}
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.ReplaceRecoveryCodes(r.Context(), userID, hashes); err != nil {
+		log.Printf("Error storing recovery codes for user %d: %v", userID, err)
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.EnableTOTP(r.Context(), userID); err != nil {
+		log.Printf("Error enabling TOTP for user %d: %v", userID, err)
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// handleSignInTOTP completes a sign-in started by handleSignIn for accounts with 2FA enabled
+func (s *Server) handleSignInTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PreAuthToken string `json:"pre_auth_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The token is redeemed up front, so every attempt at a code starts again from the password
+	userID, err := s.consumeAccountToken(r.Context(), req.PreAuthToken, preAuthPurpose)
+	if err != nil {
+		http.Error(w, "Sign-in expired, please start again", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := s.store.GetUserById(r.Context(), userID)
+	if err != nil || !user.TOTPEnabled {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are short, so guesses count against the same limits as passwords
+	emailKey, ipKey := loginEmailKey(user.Email), loginIPKey(clientIP(r))
+	if wait := s.logins.retryAfter(emailKey, ipKey); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	switch err := s.verifySecondFactor(r.Context(), user, req.Code, req.RecoveryCode); {
+	case errors.Is(err, errSecondFactorRequired):
+		http.Error(w, "A code or recovery code is required", http.StatusBadRequest)
+		return
+	case errors.Is(err, errInvalidSecondFactor):
+		s.logins.fail(emailKey, ipKey)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("Error checking the second factor of user %d: %v", userID, err)
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+
+	csrfToken, err := s.issueSession(w, r, user)
+	if err != nil {
+		log.Printf("Error signing token: %v", err)
+		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+	s.logins.succeed(emailKey)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Successfully signed in", "csrf_token": csrfToken})
+}
+
+// handleDisableTOTP turns 2FA off once the user proves they still hold a second factor
+func (s *Server) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.store.GetUserById(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+
+	emailKey, ipKey := loginEmailKey(user.Email), loginIPKey(clientIP(r))
+	if wait := s.logins.retryAfter(emailKey, ipKey); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	switch err := s.verifySecondFactor(r.Context(), user, req.Code, req.RecoveryCode); {
+	case errors.Is(err, errSecondFactorRequired):
+		http.Error(w, "A code or recovery code is required", http.StatusBadRequest)
+		return
+	case errors.Is(err, errInvalidSecondFactor):
+		s.logins.fail(emailKey, ipKey)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("Error checking the second factor of user %d: %v", userID, err)
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.store.DisableTOTP(r.Context(), userID); err != nil {
+		log.Printf("Error disabling TOTP for user %d: %v", userID, err)
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d disabled two-factor authentication", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
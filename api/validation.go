@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bcrypt ignores everything past 72 bytes, so longer passwords would silently be truncated
+const maxPasswordBytes = 72
+
+var errInvalidEmail = errors.New("must be a valid email address")
+
+// fieldError describes why a single request field was rejected
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// writeFieldErrors responds with every failing field so clients can show them next to the inputs
+func writeFieldErrors(w http.ResponseWriter, status int, errs []fieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "validation failed",
+		"fields": errs,
+	})
+}
+
+// normalizeEmail trims and lowercases a bare address, rejecting anything that isn't one
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", errInvalidEmail
+	}
+
+	at := strings.LastIndex(email, "@")
+	if !strings.Contains(email[at+1:], ".") {
+		return "", errInvalidEmail
+	}
+
+	return strings.ToLower(email), nil
+}
+
+// passwordPolicy holds the rules new passwords are checked against
+type passwordPolicy struct {
+	minLength int
+	// breached holds the hex SHA-1 of known-compromised passwords
+	breached map[string]struct{}
+}
+
+var passwordRules = &passwordPolicy{minLength: 8}
+
+// InitializePasswordPolicy loads the password policy from environment variables
+// PASSWORD_MIN_LENGTH overrides the minimum length (8 by default). PASSWORD_BREACHED_LIST points to
+// a file with one entry per line, either a plain password or a SHA-1 hash (optionally followed by
+// ":count", as in the Have I Been Pwned downloads).
+func InitializePasswordPolicy() error {
+	policy := &passwordPolicy{minLength: 8}
+
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPasswordBytes {
+			return fmt.Errorf("PASSWORD_MIN_LENGTH must be between 1 and %d", maxPasswordBytes)
+		}
+		policy.minLength = n
+	}
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		breached, err := loadBreachedPasswords(path)
+		if err != nil {
+			return err
+		}
+		policy.breached = breached
+		log.Printf("Loaded %d breached passwords", len(breached))
+	}
+
+	passwordRules = policy
+	return nil
+}
+
+func loadBreachedPasswords(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening breached password list: %w", err)
+	}
+	defer f.Close()
+
+	breached := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			breached[strings.ToLower(hash)] = struct{}{}
+			continue
+		}
+		breached[sha1Hex(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading breached password list: %w", err)
+	}
+	return breached, nil
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// check returns the reasons password is unacceptable, if any
+func (p *passwordPolicy) check(password, email string) []string {
+	var problems []string
+	if len([]rune(password)) < p.minLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.minLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes long", maxPasswordBytes))
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		problems = append(problems, "must not be the same as the email address")
+	}
+	if _, found := p.breached[sha1Hex(password)]; found {
+		problems = append(problems, "has appeared in a data breach, please choose another")
+	}
+	return problems
+}
+
+// passwordFieldErrors checks password against the policy and reports problems under field
+func passwordFieldErrors(field, password, email string) []fieldError {
+	var errs []fieldError
+	for _, problem := range passwordRules.check(password, email) {
+		errs = append(errs, fieldError{Field: field, Message: problem})
+	}
+	return errs
+}
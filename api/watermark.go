@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/alvarofc/mode/imaging"
+)
+
+// watermarkPolicy holds the watermark stamped on photos served to anyone but their owner
+type watermarkPolicy struct {
+	// mark is nil when watermarking is off
+	mark *imaging.Watermark
+}
+
+var watermarkRules = &watermarkPolicy{}
+
+// InitializeWatermarkPolicy loads WATERMARK_TEXT or WATERMARK_IMAGE (a PNG logo), WATERMARK_POSITION
+// (bottom-right), WATERMARK_OPACITY (0.5) and WATERMARK_SCALE (0.25 of the image width)
+// Watermarking is off unless a text or logo is set.
+func InitializeWatermarkPolicy() error {
+	policy := &watermarkPolicy{}
+
+	text, logo := os.Getenv("WATERMARK_TEXT"), os.Getenv("WATERMARK_IMAGE")
+	if text == "" && logo == "" {
+		watermarkRules = policy
+		return nil
+	}
+	if text != "" && logo != "" {
+		return fmt.Errorf("set either WATERMARK_TEXT or WATERMARK_IMAGE, not both")
+	}
+
+	wm := &imaging.Watermark{Position: imaging.BottomRight, Opacity: 0.5, Scale: 0.25}
+	if text != "" {
+		mark, err := imaging.TextMark(text)
+		if err != nil {
+			return fmt.Errorf("error rendering WATERMARK_TEXT: %w", err)
+		}
+		wm.Mark = mark
+	} else {
+		f, err := os.Open(logo)
+		if err != nil {
+			return fmt.Errorf("error opening WATERMARK_IMAGE: %w", err)
+		}
+		defer f.Close()
+		if wm.Mark, err = png.Decode(f); err != nil {
+			return fmt.Errorf("WATERMARK_IMAGE must be a PNG: %w", err)
+		}
+	}
+
+	if v := os.Getenv("WATERMARK_POSITION"); v != "" {
+		position, ok := imaging.ParsePosition(v)
+		if !ok {
+			return fmt.Errorf("WATERMARK_POSITION must be top-left, top-right, bottom-left, bottom-right or center, got %q", v)
+		}
+		wm.Position = position
+	}
+	if v := os.Getenv("WATERMARK_OPACITY"); v != "" {
+		opacity, err := strconv.ParseFloat(v, 64)
+		if err != nil || opacity <= 0 || opacity > 1 {
+			return fmt.Errorf("WATERMARK_OPACITY must be a number above 0 and up to 1, got %q", v)
+		}
+		wm.Opacity = opacity
+	}
+	if v := os.Getenv("WATERMARK_SCALE"); v != "" {
+		scale, err := strconv.ParseFloat(v, 64)
+		if err != nil || scale <= 0 || scale > 1 {
+			return fmt.Errorf("WATERMARK_SCALE must be a fraction of the image width above 0 and up to 1, got %q", v)
+		}
+		wm.Scale = scale
+	}
+
+	policy.mark = wm
+	watermarkRules = policy
+	return nil
+}
+
+// publicPhoto prepares a photo for someone other than its owner: its metadata is stripped and the
+// watermark, if there is one, stamped on it. It returns the photo with its content type.
+func publicPhoto(data []byte) ([]byte, string, error) {
+	data, err := imaging.StripMetadata(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if watermarkRules.mark == nil {
+		return data, http.DetectContentType(data), nil
+	}
+	return imaging.WatermarkPhoto(data, watermarkRules.mark)
+}
@@ -0,0 +1,37 @@
+package imaging
+
+import "github.com/alvarofc/mode/types"
+
+// Analysis is everything derived from an image when it is stored
+type Analysis struct {
+	Hash     uint64
+	Metadata types.ImageMetadata
+}
+
+// Analyze decodes an image and extracts its hash, dimensions, type, EXIF fields, palette and BlurHash
+// The image is decoded once, through Decode, so images over MaxPixels return ErrTooLarge.
+// Unreadable EXIF data is ignored.
+func Analyze(data []byte) (Analysis, error) {
+	img, format, err := Decode(data)
+	if err != nil {
+		return Analysis{}, err
+	}
+
+	bounds := img.Bounds()
+	meta := types.ImageMetadata{
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		MIMEType: "image/" + format,
+		Palette:  Palette(img, 5),
+		BlurHash: BlurHash(img, 4, 3),
+	}
+	if exif, err := ReadEXIF(data, true); err == nil && exif != nil {
+		meta.EXIF = exif
+		// Orientations 5 to 8 rotate by 90 degrees, so viewers swap the sides
+		if exif.Orientation >= 5 {
+			meta.Width, meta.Height = meta.Height, meta.Width
+		}
+	}
+
+	return Analysis{Hash: DHash(img), Metadata: meta}, nil
+}
@@ -0,0 +1,159 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// thumbnail shrinks img so colors can be summarised without visiting every pixel
+func thumbnail(img image.Image, size uint) image.Image {
+	return resize.Thumbnail(size, size, img, resize.Bilinear)
+}
+
+// Palette returns up to n dominant colors of img as #rrggbb, most common first
+// Colors are bucketed at 4 bits per channel and each bucket is reported as the average of its pixels.
+func Palette(img image.Image, n int) []string {
+	type bucket struct {
+		r, g, b, count int
+	}
+	buckets := make(map[int]*bucket)
+
+	small := thumbnail(img, 64)
+	bounds := small.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(small.At(x, y)).(color.NRGBA)
+			// Mostly transparent pixels show the background, not the image
+			if c.A < 128 {
+				continue
+			}
+			id := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			b, ok := buckets[id]
+			if !ok {
+				b = &bucket{}
+				buckets[id] = b
+			}
+			b.r += int(c.R)
+			b.g += int(c.G)
+			b.b += int(c.B)
+			b.count++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, b := range buckets {
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].count > sorted[j].count
+	})
+
+	var palette []string
+	for _, b := range sorted {
+		if len(palette) == n {
+			break
+		}
+		palette = append(palette, fmt.Sprintf("#%02x%02x%02x", b.r/b.count, b.g/b.count, b.b/b.count))
+	}
+	return palette
+}
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encode83(sb *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		sb.WriteByte(base83[value/int(math.Pow(83, float64(i)))%83])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	c := math.Max(0, math.Min(1, v))
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// BlurHash encodes img as a BlurHash (https://blurha.sh) with x by y components, each between 1 and 9
+func BlurHash(img image.Image, x, y int) string {
+	small := thumbnail(img, 32)
+	bounds := small.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Convert once, the components below visit every pixel x*y times
+	pixels := make([][3]float64, width*height)
+	for py := 0; py < height; py++ {
+		for px := 0; px < width; px++ {
+			c := color.NRGBAModel.Convert(small.At(bounds.Min.X+px, bounds.Min.Y+py)).(color.NRGBA)
+			pixels[py*width+px] = [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, x*y)
+	for j := 0; j < y; j++ {
+		for i := 0; i < x; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for py := 0; py < height; py++ {
+				for px := 0; px < width; px++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(px)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(py)/float64(height))
+					p := pixels[py*width+px]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encode83(&sb, (x-1)+(y-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		encode83(&sb, quantised, 1)
+	} else {
+		encode83(&sb, 0, 1)
+	}
+
+	encode83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		encode83(&sb, quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+	return sb.String()
+}
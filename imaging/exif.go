@@ -0,0 +1,259 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+)
+
+// EXIF tags that are read; see the EXIF 2.32 specification
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSoftware         = 0x0131
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829a
+	tagFNumber          = 0x829d
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagOffsetOriginal   = 0x9011
+	tagFocalLength      = 0x920a
+	tagLensModel        = 0xa434
+
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+
+	errBadTIFF = errors.New("malformed EXIF data")
+)
+
+// exifSegment returns the TIFF data of the EXIF segment of a JPEG, or nil if there is none
+func exifSegment(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if i = skipFill(data, i); i+4 > len(data) || data[i] != 0xff {
+			return nil
+		}
+		marker := data[i+1]
+		// Start of scan: the metadata segments are all before it
+		if marker == 0xda || marker == 0xd9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		if marker == 0xe1 && bytes.HasPrefix(data[i+4:end], exifHeader) {
+			return data[i+4+len(exifHeader) : end]
+		}
+		i = end
+	}
+	return nil
+}
+
+// skipFill moves i past the 0xff fill bytes that may pad the JPEG marker starting at i
+func skipFill(data []byte, i int) int {
+	for i+1 < len(data) && data[i] == 0xff && data[i+1] == 0xff {
+		i++
+	}
+	return i
+}
+
+// tiff reads the image file directories of EXIF data
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	// value holds the value itself when it fits in 4 bytes, otherwise where it is
+	value []byte
+}
+
+// typeSizes are the sizes of the TIFF field types that are read
+var typeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (t *tiff) ifd(offset uint32) (map[uint16]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errBadTIFF
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	if uint64(offset)+2+uint64(n)*12 > uint64(len(t.data)) {
+		return nil, errBadTIFF
+	}
+
+	entries := make(map[uint16]ifdEntry, n)
+	for i := uint32(0); i < n; i++ {
+		raw := t.data[offset+2+i*12:]
+		entry := ifdEntry{typ: t.order.Uint16(raw[2:]), count: t.order.Uint32(raw[4:])}
+		size, ok := typeSizes[entry.typ]
+		if !ok || entry.count > uint32(len(t.data)) {
+			continue
+		}
+		if total := size * entry.count; total <= 4 {
+			entry.value = raw[8 : 8+total]
+		} else {
+			at := t.order.Uint32(raw[8:])
+			if uint64(at)+uint64(total) > uint64(len(t.data)) {
+				continue
+			}
+			entry.value = t.data[at : at+total]
+		}
+		entries[t.order.Uint16(raw)] = entry
+	}
+	return entries, nil
+}
+
+func (t *tiff) string(e ifdEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// uint reads the first integer of a BYTE, SHORT or LONG entry
+func (t *tiff) uint(e ifdEntry) (uint32, bool) {
+	switch {
+	case e.typ == 1 && len(e.value) >= 1:
+		return uint32(e.value[0]), true
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value)), true
+	case e.typ == 4 && len(e.value) >= 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// rationals reads the values of a RATIONAL or SRATIONAL entry
+func (t *tiff) rationals(e ifdEntry) []float64 {
+	if e.typ != 5 && e.typ != 10 {
+		return nil
+	}
+	var values []float64
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num, den := t.order.Uint32(e.value[i:]), t.order.Uint32(e.value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		if e.typ == 10 {
+			values = append(values, float64(int32(num))/float64(int32(den)))
+		} else {
+			values = append(values, float64(num)/float64(den))
+		}
+	}
+	return values
+}
+
+func (t *tiff) rational(e ifdEntry) float64 {
+	if values := t.rationals(e); len(values) > 0 && !math.IsInf(values[0], 0) && !math.IsNaN(values[0]) {
+		return values[0]
+	}
+	return 0
+}
+
+// degrees converts GPS degrees, minutes and seconds to decimal degrees, negative for ref S or W
+func (t *tiff) degrees(e ifdEntry, ref string) (float64, bool) {
+	dms := t.rationals(e)
+	if len(dms) != 3 {
+		return 0, false
+	}
+	deg := dms[0] + dms[1]/60 + dms[2]/3600
+	if ref == "S" || ref == "W" {
+		deg = -deg
+	}
+	return deg, true
+}
+
+// ReadEXIF reads the camera fields of a JPEG, returning nil if it has no EXIF data
+// With gps false the location is left out.
+func ReadEXIF(data []byte, gps bool) (*types.EXIF, error) {
+	segment := exifSegment(data)
+	if len(segment) < 8 {
+		return nil, nil
+	}
+
+	t := &tiff{data: segment}
+	switch string(segment[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errBadTIFF
+	}
+	if t.order.Uint16(segment[2:]) != 42 {
+		return nil, errBadTIFF
+	}
+
+	ifd0, err := t.ifd(t.order.Uint32(segment[4:]))
+	if err != nil {
+		return nil, err
+	}
+	exif := &types.EXIF{
+		Make:     t.string(ifd0[tagMake]),
+		Model:    t.string(ifd0[tagModel]),
+		Software: t.string(ifd0[tagSoftware]),
+	}
+	if v, ok := t.uint(ifd0[tagOrientation]); ok && v >= 1 && v <= 8 {
+		exif.Orientation = int(v)
+	}
+
+	if offset, ok := t.uint(ifd0[tagExifIFD]); ok {
+		if sub, err := t.ifd(offset); err == nil {
+			exif.LensModel = t.string(sub[tagLensModel])
+			exif.ExposureTime = t.rational(sub[tagExposureTime])
+			exif.FNumber = t.rational(sub[tagFNumber])
+			exif.FocalLength = t.rational(sub[tagFocalLength])
+			if v, ok := t.uint(sub[tagISO]); ok {
+				exif.ISO = int(v)
+			}
+			if taken := t.string(sub[tagDateTimeOriginal]); taken != "" {
+				// Without an offset the camera's local time is assumed to be UTC
+				layout, value := "2006:01:02 15:04:05", taken
+				if offset := t.string(sub[tagOffsetOriginal]); offset != "" {
+					layout, value = layout+"-07:00", taken+offset
+				}
+				if at, err := time.Parse(layout, value); err == nil {
+					exif.TakenAt = &at
+				}
+			}
+		}
+	}
+
+	if offset, ok := t.uint(ifd0[tagGPSIFD]); ok && gps {
+		if sub, err := t.ifd(offset); err == nil {
+			lat, latOK := t.degrees(sub[tagGPSLatitude], t.string(sub[tagGPSLatitudeRef]))
+			long, longOK := t.degrees(sub[tagGPSLongitude], t.string(sub[tagGPSLongitudeRef]))
+			if latOK && longOK {
+				exif.GPS = &types.GPS{Latitude: lat, Longitude: long, Altitude: t.rational(sub[tagGPSAltitude])}
+				if ref, ok := t.uint(sub[tagGPSAltitudeRef]); ok && ref == 1 {
+					exif.GPS.Altitude = -exif.GPS.Altitude
+				}
+			}
+		}
+	}
+
+	if *exif == (types.EXIF{}) {
+		return nil, nil
+	}
+	return exif, nil
+}
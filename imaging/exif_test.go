@@ -0,0 +1,50 @@
+package imaging
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReadEXIF(t *testing.T) {
+	// exif.jpg pads a marker with fill bytes, which mustn't stop the scan
+	for _, name := range []string{"jfif-exif.jpg", "exif.jpg"} {
+		t.Run(name, func(t *testing.T) {
+			exif, err := ReadEXIF(readFixture(t, name), true)
+			if err != nil || exif == nil {
+				t.Fatalf("ReadEXIF = %v, %v", exif, err)
+			}
+			if exif.Make != "Canon" || exif.Model != "Canon EOS 5D Mark IV" || exif.LensModel != "EF24-70mm f/2.8L II USM" || exif.Software != "Firmware Version 1.4.2" {
+				t.Errorf("camera = %q %q %q %q", exif.Make, exif.Model, exif.LensModel, exif.Software)
+			}
+			if exif.Orientation != 6 || exif.FNumber != 2.8 {
+				t.Errorf("orientation %d, f/%v", exif.Orientation, exif.FNumber)
+			}
+			want := time.Date(2021, 6, 15, 12, 32, 10, 0, time.UTC)
+			if exif.TakenAt == nil || !exif.TakenAt.Equal(want) {
+				t.Errorf("taken at %v, want %v", exif.TakenAt, want)
+			}
+			if exif.GPS == nil || math.Abs(exif.GPS.Latitude-48.858233) > 1e-6 || math.Abs(exif.GPS.Longitude-2.2945) > 1e-6 || exif.GPS.Altitude != 35 {
+				t.Errorf("GPS = %+v", exif.GPS)
+			}
+		})
+	}
+}
+
+func TestReadEXIFWithoutGPS(t *testing.T) {
+	exif, err := ReadEXIF(readFixture(t, "exif.jpg"), false)
+	if err != nil || exif == nil {
+		t.Fatalf("ReadEXIF = %v, %v", exif, err)
+	}
+	if exif.GPS != nil {
+		t.Errorf("GPS = %+v, want none", exif.GPS)
+	}
+}
+
+func TestReadEXIFNone(t *testing.T) {
+	for _, name := range []string{"metadata.png", "metadata.webp"} {
+		if exif, err := ReadEXIF(readFixture(t, name), true); exif != nil || err != nil {
+			t.Errorf("%s: ReadEXIF = %+v, %v, want nothing", name, exif, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package imaging decodes stored photos and derives data from their pixels
+package imaging
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+
+	"github.com/nfnt/resize"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels caps the width × height of the images that are decoded. A few kilobytes can declare
+// a huge bitmap, so the header is checked before any pixel memory is allocated.
+const MaxPixels = 50_000_000
+
+// ErrTooLarge is returned for images with more than MaxPixels pixels
+var ErrTooLarge = errors.New("image has too many pixels")
+
+// CheckDimensions reads the image header and refuses images larger than MaxPixels
+func CheckDimensions(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error decoding image: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return fmt.Errorf("error decoding image: invalid dimensions %dx%d", config.Width, config.Height)
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return fmt.Errorf("%w: %dx%d", ErrTooLarge, config.Width, config.Height)
+	}
+	return nil
+}
+
+// Decode decodes a PNG, JPEG, GIF or WebP image of at most MaxPixels pixels and returns its format
+func Decode(data []byte) (image.Image, string, error) {
+	if err := CheckDimensions(data); err != nil {
+		return nil, "", err
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding image: %w", err)
+	}
+	return img, format, nil
+}
+
+// Checksum returns the hex-encoded SHA-256 of data, which identifies byte-identical uploads
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// DHash computes the difference hash of img: it is shrunk to 9x8 grayscale pixels and each bit
+// records whether a pixel is brighter than its right neighbour. Resizing, recompression and small
+// edits change few bits, so similar images have hashes a small Hamming distance apart.
+// Only the 72 shrunk pixels are converted to gray, so full-size images are read just once.
+func DHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(x, y)).(color.Gray).Y
+			right := color.GrayModel.Convert(small.At(x+1, y)).(color.Gray).Y
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// Distance returns the number of bits that differ between two hashes
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
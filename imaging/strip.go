@@ -0,0 +1,145 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	errTruncated = errors.New("truncated image")
+)
+
+// StripMetadata removes the metadata that can identify where, when and with what a photo was taken:
+// EXIF (including GPS), XMP, IPTC and comments. Pixels and color profiles are left alone, and a JPEG
+// keeps its EXIF orientation so it still displays the right way up. Other formats are returned as is.
+func StripMetadata(data []byte) ([]byte, error) {
+	switch {
+	case len(data) >= 2 && data[0] == 0xff && data[1] == 0xd8:
+		return stripJPEG(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return stripPNG(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return stripWebP(data)
+	}
+	return data, nil
+}
+
+// orientationSegment is an APP1 segment whose EXIF data only holds the orientation
+func orientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big-endian header, IFD0 at offset 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // Orientation, SHORT, 1 value
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// stripJPEG drops the APP1 (EXIF, XMP), APP13 (IPTC) and comment segments before the image data
+// The orientation is written back where EXIF belongs: right after SOI, or after the JFIF APP0 segment.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+
+	orientation := 0
+	if exif, err := ReadEXIF(data, false); err == nil && exif != nil && exif.Orientation > 1 {
+		orientation = exif.Orientation
+	}
+
+	i := 2
+	for {
+		i = skipFill(data, i)
+		if i+2 > len(data) || data[i] != 0xff {
+			return nil, errTruncated
+		}
+		marker := data[i+1]
+		if orientation > 0 && marker != 0xe0 {
+			out = append(out, orientationSegment(orientation)...)
+			orientation = 0
+		}
+		// Everything from the start of scan on is image data
+		if marker == 0xda {
+			return append(out, data[i:]...), nil
+		}
+		if i+4 > len(data) {
+			return nil, errTruncated
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil, errTruncated
+		}
+		switch marker {
+		case 0xe1, 0xed, 0xfe:
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+}
+
+// pngMetadataChunks are the ancillary chunks holding EXIF, XMP and text such as comments or authors
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errTruncated
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, errTruncated
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripWebP drops the EXIF and XMP chunks and clears their flags in the VP8X header
+func stripWebP(data []byte) ([]byte, error) {
+	const (
+		exifFlag = 0x08
+		xmpFlag  = 0x04
+	)
+
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errTruncated
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		// Chunks are padded to an even size
+		end := i + 8 + size + size%2
+		if end > len(data) || end < i {
+			return nil, errTruncated
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, data[i:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= exifFlag | xmpFlag
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,195 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// jpegMarkers lists the markers of the segments before the image data
+func jpegMarkers(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var markers []byte
+	for i := 2; ; {
+		i = skipFill(data, i)
+		if i+4 > len(data) || data[i] != 0xff {
+			t.Fatalf("bad marker at %d", i)
+		}
+		markers = append(markers, data[i+1])
+		if data[i+1] == 0xda {
+			return markers
+		}
+		i += 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+	}
+}
+
+func pngChunks(data []byte) []string {
+	var chunks []string
+	for i := len(pngSignature); i+12 <= len(data); i += 12 + int(binary.BigEndian.Uint32(data[i:])) {
+		chunks = append(chunks, string(data[i+4:i+8]))
+	}
+	return chunks
+}
+
+func webpChunks(data []byte) []string {
+	var chunks []string
+	for i := 12; i+8 <= len(data); {
+		chunks = append(chunks, string(data[i:i+4]))
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		i += 8 + size + size%2
+	}
+	return chunks
+}
+
+// samePixels decodes both images and compares them
+func samePixels(t *testing.T, want, got []byte) {
+	t.Helper()
+	a, _, err := image.Decode(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := image.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("stripped image doesn't decode: %v", err)
+	}
+	if a.Bounds() != b.Bounds() {
+		t.Fatalf("bounds = %v, want %v", b.Bounds(), a.Bounds())
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			if a.At(x, y) != b.At(x, y) {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, b.At(x, y), a.At(x, y))
+			}
+		}
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	tests := []struct {
+		fixture string
+		markers []byte
+	}{
+		// The orientation goes right after the JFIF header, which must stay first
+		{"jfif-exif.jpg", []byte{0xe0, 0xe1, 0xdb, 0xc0, 0xc4, 0xda}},
+		// Without one it goes right after SOI
+		{"exif.jpg", []byte{0xe1, 0xdb, 0xc0, 0xc4, 0xda}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data := readFixture(t, tt.fixture)
+			out, err := StripMetadata(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := jpegMarkers(t, out); !bytes.Equal(got, tt.markers) {
+				t.Errorf("markers = % x, want % x", got, tt.markers)
+			}
+			for _, leak := range []string{"Canon", "Firmware", "EF24-70mm", "2021:06:15", "xmpmeta", "Photoshop 3.0", "Jane Doe", "Rue de Rivoli"} {
+				if bytes.Contains(out, []byte(leak)) {
+					t.Errorf("stripped image still contains %q", leak)
+				}
+			}
+
+			exif, err := ReadEXIF(out, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exif == nil || exif.Orientation != 6 || exif.Make != "" || exif.GPS != nil || exif.TakenAt != nil {
+				t.Errorf("EXIF = %+v, want only orientation 6", exif)
+			}
+			samePixels(t, data, out)
+
+			again, err := StripMetadata(out)
+			if err != nil || !bytes.Equal(again, out) {
+				t.Errorf("stripping twice changed the image: %v", err)
+			}
+		})
+	}
+}
+
+func TestStripJPEGWithoutOrientation(t *testing.T) {
+	data := readFixture(t, "exif.jpg")
+	// Take the EXIF segment out entirely
+	end := 2 + 2 + int(binary.BigEndian.Uint16(data[4:]))
+	data = append(append([]byte{}, data[:2]...), data[end:]...)
+
+	out, err := StripMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := jpegMarkers(t, out), []byte{0xdb, 0xc0, 0xc4, 0xda}; !bytes.Equal(got, want) {
+		t.Errorf("markers = % x, want % x", got, want)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	data := readFixture(t, "metadata.png")
+	out, err := StripMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := pngChunks(out), []string{"IHDR", "gAMA", "IDAT", "IEND"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks = %v, want %v", got, want)
+	}
+	for _, leak := range []string{"Canon", "Jane Doe", "Taken at home"} {
+		if bytes.Contains(out, []byte(leak)) {
+			t.Errorf("stripped image still contains %q", leak)
+		}
+	}
+	samePixels(t, data, out)
+}
+
+func TestStripWebP(t *testing.T) {
+	data := readFixture(t, "metadata.webp")
+	out, err := StripMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := webpChunks(out), []string{"VP8X", "VP8L"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks = %v, want %v", got, want)
+	}
+	if flags := out[20]; flags&(0x08|0x04) != 0 {
+		t.Errorf("VP8X flags = %#x, EXIF and XMP still set", flags)
+	}
+	if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+		t.Errorf("RIFF size = %d, want %d", size, len(out)-8)
+	}
+	if bytes.Contains(out, []byte("Canon")) {
+		t.Error("stripped image still contains the camera make")
+	}
+	samePixels(t, data, out)
+}
+
+func TestStripOtherFormats(t *testing.T) {
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+	out, err := StripMetadata(gif)
+	if err != nil || !bytes.Equal(out, gif) {
+		t.Errorf("StripMetadata changed a GIF: %v", err)
+	}
+}
+
+func TestStripTruncated(t *testing.T) {
+	for _, name := range []string{"jfif-exif.jpg", "metadata.png", "metadata.webp"} {
+		data := readFixture(t, name)
+		// Cut inside the first segment after the header
+		if _, err := StripMetadata(data[:24]); !errors.Is(err, errTruncated) {
+			t.Errorf("%s: err = %v, want errTruncated", name, err)
+		}
+	}
+}
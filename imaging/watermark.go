@@ -0,0 +1,183 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Position is the corner, or the center, of an image where a watermark is placed
+type Position string
+
+const (
+	TopLeft     Position = "top-left"
+	TopRight    Position = "top-right"
+	BottomLeft  Position = "bottom-left"
+	BottomRight Position = "bottom-right"
+	Center      Position = "center"
+)
+
+// ParsePosition checks that s names a Position
+func ParsePosition(s string) (Position, bool) {
+	switch p := Position(s); p {
+	case TopLeft, TopRight, BottomLeft, BottomRight, Center:
+		return p, true
+	}
+	return "", false
+}
+
+// Watermark is an overlay stamped on photos served to people other than their owner
+type Watermark struct {
+	// Mark is the overlay, a rendered text or a logo, with transparency
+	Mark     image.Image
+	Position Position
+	// Opacity scales the alpha of the mark, from 0 (invisible) to 1
+	Opacity float64
+	// Scale is the width of the mark as a fraction of the width of the image
+	Scale float64
+}
+
+// textSize is the font size text marks are rendered at; they are scaled to each image afterwards
+const textSize = 64
+
+// TextMark renders text as white bold letters with a dark outline, readable on light and dark photos
+func TextMark(text string) (image.Image, error) {
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing font: %w", err)
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: textSize, DPI: 72, Hinting: font.HintingNone})
+	if err != nil {
+		return nil, fmt.Errorf("error loading font: %w", err)
+	}
+	defer face.Close()
+
+	const outline = textSize / 16
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil() + 2*outline
+	height := (metrics.Ascent + metrics.Descent).Ceil() + 2*outline
+	mark := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	drawer := &font.Drawer{Dst: mark, Face: face, Src: image.NewUniform(color.NRGBA{A: 0xc0})}
+	origin := fixed.P(outline, outline+metrics.Ascent.Ceil())
+	for dy := -outline; dy <= outline; dy++ {
+		for dx := -outline; dx <= outline; dx++ {
+			drawer.Dot = origin.Add(fixed.P(dx, dy))
+			drawer.DrawString(text)
+		}
+	}
+	drawer.Src, drawer.Dot = image.White, origin
+	drawer.DrawString(text)
+	return mark, nil
+}
+
+// Apply returns a copy of img with the watermark drawn over it
+func (wm *Watermark) Apply(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	width := uint(math.Max(1, math.Round(float64(bounds.Dx())*wm.Scale)))
+	mark := resize.Resize(width, 0, wm.Mark, resize.Bilinear)
+	size := mark.Bounds().Size()
+
+	margin := min(bounds.Dx(), bounds.Dy()) / 50
+	right, bottom := bounds.Dx()-size.X-margin, bounds.Dy()-size.Y-margin
+	var at image.Point
+	switch wm.Position {
+	case TopLeft:
+		at = image.Pt(margin, margin)
+	case TopRight:
+		at = image.Pt(right, margin)
+	case BottomLeft:
+		at = image.Pt(margin, bottom)
+	case Center:
+		at = image.Pt((bounds.Dx()-size.X)/2, (bounds.Dy()-size.Y)/2)
+	default:
+		at = image.Pt(right, bottom)
+	}
+
+	opacity := image.NewUniform(color.Alpha{A: uint8(math.Round(math.Max(0, math.Min(1, wm.Opacity)) * 255))})
+	draw.DrawMask(dst, image.Rectangle{Min: at, Max: at.Add(size)}, mark, mark.Bounds().Min, opacity, image.Point{}, draw.Over)
+	return dst
+}
+
+// orient turns img the way its EXIF orientation says it is displayed, since re-encoding drops the tag
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// source returns which pixel of img ends up at x, y
+	var source func(x, y int) (int, int)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	switch orientation {
+	case 2:
+		source = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3:
+		source = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4:
+		source = func(x, y int) (int, int) { return x, h - 1 - y }
+	default:
+		// Orientations 5 to 8 swap the sides
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+		switch orientation {
+		case 5:
+			source = func(x, y int) (int, int) { return y, x }
+		case 6:
+			source = func(x, y int) (int, int) { return y, h - 1 - x }
+		case 7:
+			source = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+		case 8:
+			source = func(x, y int) (int, int) { return w - 1 - y, x }
+		}
+	}
+
+	out := dst.Bounds()
+	for y := 0; y < out.Dy(); y++ {
+		for x := 0; x < out.Dx(); x++ {
+			sx, sy := source(x, y)
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// WatermarkPhoto stamps wm on an encoded photo and returns the result with its content type
+// JPEGs stay JPEGs; other formats, which can't all be encoded, become PNG. Only the first frame of
+// an animated GIF is kept, and like StripMetadata the result carries no metadata.
+func WatermarkPhoto(data []byte, wm *Watermark) ([]byte, string, error) {
+	img, format, err := Decode(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if exif, err := ReadEXIF(data, false); err == nil && exif != nil {
+		img = orient(img, exif.Orientation)
+	}
+	marked := wm.Apply(img)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		if err := jpeg.Encode(&buf, marked, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, "", fmt.Errorf("error encoding JPEG: %w", err)
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+	if err := png.Encode(&buf, marked); err != nil {
+		return nil, "", fmt.Errorf("error encoding PNG: %w", err)
+	}
+	return buf.Bytes(), "image/png", nil
+}
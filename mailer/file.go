@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// File writes messages to a local file instead of sending them
+// It is meant for local development, where links can be copied from the output
+type File struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileMailer creates a Mailer that appends messages to the file at path
+// If path is empty, messages are written to the standard logger
+func NewFileMailer(path string) *File {
+	return &File{path: path}
+}
+
+// Send records the message
+func (m *File) Send(msg Message) error {
+	entry := fmt.Sprintf(
+		"--- %s\nTo: %s\nSubject: %s\n\n%s\n",
+		time.Now().Format(time.RFC3339), msg.To, msg.Subject, msg.Body,
+	)
+
+	if m.path == "" {
+		log.Print(entry)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening mail file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(entry); err != nil {
+		return fmt.Errorf("error writing mail file: %w", err)
+	}
+	return nil
+}
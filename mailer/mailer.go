@@ -0,0 +1,13 @@
+package mailer
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends transactional emails such as verification and password reset links
+type Mailer interface {
+	Send(msg Message) error
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/alvarofc/mode/api"
+	"github.com/alvarofc/mode/mailer"
 	"github.com/alvarofc/mode/storage"
 	"github.com/joho/godotenv"
 )
@@ -16,26 +21,167 @@ func main() {
 		log.Fatalf("Error loading .env file: %s", err)
 	}
 
+	listenAddr := flag.String("listenaddr", ":8080", "The address to listen on for HTTP requests.")
+	migrateOnStart := flag.Bool("migrate", os.Getenv("MIGRATE_ON_START") == "true", "Apply pending database migrations before starting the server.")
+	flag.Parse()
+
+	var store storage.Storage
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "postgres":
+		pg, err := openPostgres()
+		if err != nil {
+			log.Fatalf("Error creating postgres client: %v", err)
+		}
+
+		// mode migrate up|down [steps]|status
+		if flag.Arg(0) == "migrate" {
+			if err := runMigrate(context.Background(), pg, flag.Args()[1:]); err != nil {
+				log.Fatalf("Migration failed: %v", err)
+			}
+			return
+		}
+
+		if *migrateOnStart {
+			applied, err := pg.MigrateUp(context.Background())
+			if err != nil {
+				log.Fatalf("Migration failed: %v", err)
+			}
+			log.Printf("Applied %d pending migrations", applied)
+		}
+		store = pg
+	case "memory":
+		if flag.Arg(0) == "migrate" {
+			log.Fatal("Migrations only apply to the postgres storage backend")
+		}
+		// Single-node development: everything is lost when the process exits
+		log.Println("Using in-memory storage, data will not persist across restarts")
+		store = storage.NewMemory()
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected postgres or memory", backend)
+	}
+
 	if err := api.InitializeKeys(); err != nil {
 		log.Fatalf("Failed to initialize keys: %v", err)
 	}
 
-	listenAddr := flag.String("listenaddr", ":8080", "The address to listen on for HTTP requests.")
-	flag.Parse()
+	if err := api.InitializePasswordPolicy(); err != nil {
+		log.Fatalf("Failed to initialize password policy: %v", err)
+	}
 
-	pg, err := storage.NewPostgres(
-		os.Getenv("DB_HOST"),     // host
-		os.Getenv("DB_PORT"),     // port
-		os.Getenv("DB_USER"),     // user
-		os.Getenv("DB_PASSWORD"), // password
-		os.Getenv("DB_NAME"),     // dbname
-	)
+	if err := api.InitializeCORSPolicy(); err != nil {
+		log.Fatalf("Failed to initialize CORS policy: %v", err)
+	}
+
+	if err := api.InitializeCookiePolicy(); err != nil {
+		log.Fatalf("Failed to initialize cookie policy: %v", err)
+	}
+
+	if err := api.InitializeTrashPolicy(); err != nil {
+		log.Fatalf("Failed to initialize trash policy: %v", err)
+	}
+	if err := api.InitializeDuplicatePolicy(); err != nil {
+		log.Fatalf("Failed to initialize duplicate policy: %v", err)
+	}
+	if err := api.InitializeWatermarkPolicy(); err != nil {
+		log.Fatalf("Failed to initialize watermark policy: %v", err)
+	}
+
+	urls, err := storage.URLConfigFromEnv()
 	if err != nil {
-		log.Fatalf("Error creating postgres client: %v", err)
+		log.Fatalf("Invalid photo URL configuration: %v", err)
+	}
+
+	var files storage.S3
+	switch backend := os.Getenv("S3_BACKEND"); backend {
+	case "", "s3":
+		photoCache, cacheTTL, err := openCache()
+		if err != nil {
+			log.Fatalf("Error creating cache: %v", err)
+		}
+		s3 := storage.NewS3Client(os.Getenv("KEY_ID"), os.Getenv("APP_KEY"), os.Getenv("S3_URL"), os.Getenv("S3_REGION"), photoCache, cacheTTL)
+		s3.URLs = urls
+		files = &s3
+	case "local":
+		local, err := openLocalFS()
+		if err != nil {
+			log.Fatalf("Error creating local file storage: %v", err)
+		}
+		local.URLTTL = urls.TTL
+		files = local
+	default:
+		log.Fatalf("Unknown S3_BACKEND %q, expected s3 or local", backend)
+	}
+
+	var mail mailer.Mailer
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		mail = mailer.NewSMTP(smtpHost, os.Getenv("SMTP_PORT"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_FROM"))
+	} else {
+		// Local development: write emails to a file (or the log) instead of sending them
+		mail = mailer.NewFileMailer(os.Getenv("MAIL_LOG_FILE"))
 	}
-	s3 := storage.NewS3Client(os.Getenv("KEY_ID"), os.Getenv("APP_KEY"), os.Getenv("S3_URL"), os.Getenv("S3_REGION"))
 
-	server := api.NewServer(*listenAddr, pg, &s3)
+	server := api.NewServer(*listenAddr, store, files, mail)
 	log.Println("Server running on port: ", *listenAddr)
 	log.Fatal(server.Start())
 }
+
+func openPostgres() (*storage.Postgres, error) {
+	pgConfig, err := storage.PostgresConfigFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid database configuration: %w", err)
+	}
+	return storage.NewPostgres(context.Background(), pgConfig)
+}
+
+// openLocalFS stores photos under LOCAL_STORAGE_DIR and serves them through GET /files
+func openLocalFS() (*storage.LocalFS, error) {
+	dir := os.Getenv("LOCAL_STORAGE_DIR")
+	if dir == "" {
+		dir = "data/photos"
+	}
+	baseURL := os.Getenv("LOCAL_STORAGE_URL")
+	if baseURL == "" {
+		baseURL = "/files"
+	}
+
+	secret := []byte(os.Getenv("LOCAL_STORAGE_SECRET"))
+	if len(secret) == 0 {
+		// Links then stop working when the process restarts
+		log.Println("LOCAL_STORAGE_SECRET is not set, signing file links with a random key")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return storage.NewLocalFS(dir, baseURL, secret)
+}
+
+// openCache selects the cache for photo listings from CACHE_BACKEND (memory or redis) and CACHE_TTL
+func openCache() (storage.Cache, time.Duration, error) {
+	ttl := 5 * time.Minute
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, 0, fmt.Errorf("CACHE_TTL must be a positive duration, got %q", v)
+		}
+		ttl = d
+	}
+
+	switch backend := os.Getenv("CACHE_BACKEND"); backend {
+	case "", "memory":
+		return storage.NewMemoryCache(), ttl, nil
+	case "redis":
+		prefix := os.Getenv("REDIS_KEY_PREFIX")
+		if prefix == "" {
+			prefix = "mode:"
+		}
+		c, err := storage.NewRedisCache(context.Background(), os.Getenv("REDIS_URL"), prefix)
+		if err != nil {
+			return nil, 0, err
+		}
+		return c, ttl, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown CACHE_BACKEND %q, expected memory or redis", backend)
+	}
+}
@@ -0,0 +1,61 @@
+package oidc
+
+import (
+	"os"
+	"strings"
+)
+
+// Defaults for well-known providers; anything else must be configured explicitly
+var presets = map[string]Config{
+	"google": {
+		Issuer: "https://accounts.google.com",
+		Scopes: []string{"openid", "email", "profile"},
+	},
+	"github": {
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		EmailsURL:   "https://api.github.com/user/emails",
+		Scopes:      []string{"read:user", "user:email"},
+	},
+}
+
+// ProvidersFromEnv builds the providers listed in OIDC_PROVIDERS (comma separated)
+// Each provider NAME reads OIDC_<NAME>_CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL and optionally
+// _ISSUER, _AUTH_URL, _TOKEN_URL, _USERINFO_URL and _SCOPES, which override the presets.
+// Pointing _ISSUER at a local mock provider is enough to exercise the whole flow.
+func ProvidersFromEnv() map[string]*Provider {
+	providers := make(map[string]*Provider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := presets[name]
+		cfg.Name = name
+		cfg.ClientID = os.Getenv(prefix + "CLIENT_ID")
+		cfg.ClientSecret = os.Getenv(prefix + "CLIENT_SECRET")
+		cfg.RedirectURL = os.Getenv(prefix + "REDIRECT_URL")
+		override(&cfg.Issuer, prefix+"ISSUER")
+		override(&cfg.AuthURL, prefix+"AUTH_URL")
+		override(&cfg.TokenURL, prefix+"TOKEN_URL")
+		override(&cfg.UserInfoURL, prefix+"USERINFO_URL")
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			cfg.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		}
+		if cfg.Issuer != "" && len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "email"}
+		}
+
+		providers[name] = NewProvider(cfg)
+	}
+	return providers
+}
+
+func override(field *string, env string) {
+	if v := os.Getenv(env); v != "" {
+		*field = v
+	}
+}
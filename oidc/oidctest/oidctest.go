@@ -0,0 +1,202 @@
+// Package oidctest is a mock OpenID Connect provider for testing logins end to end
+//
+// It serves discovery, the JWKS and the token endpoint from an httptest server and signs ID
+// tokens with a key of its own. The browser's visit to the authorization endpoint is replaced
+// by Authorize, which approves a login as whoever the test chooses:
+//
+//	issuer := oidctest.NewIssuer(t)
+//	provider := oidc.NewProvider(issuer.Config("mock", redirectURL))
+//	authURL, _ := provider.AuthCodeURL(ctx, state, nonce, oidc.CodeChallenge(verifier))
+//	code, state := issuer.Authorize(t, authURL, oidctest.Login{Subject: "alice", Email: "alice@example.com", EmailVerified: true})
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alvarofc/mode/oidc"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	// ClientID and ClientSecret are the credentials the issuer accepts
+	ClientID     = "oidctest-client"
+	ClientSecret = "oidctest-secret"
+
+	keyID = "oidctest"
+)
+
+// Login is the account a user signs in to the provider with
+type Login struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	// Nonce replaces the nonce of the authorization request in the ID token, to check that it is verified
+	Nonce string
+}
+
+// grant is an authorization code waiting to be redeemed
+type grant struct {
+	login       Login
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+// Issuer is a running mock provider; its URL is the issuer identifier
+type Issuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	codes  map[string]grant
+	serial int
+}
+
+// NewIssuer starts a mock provider that is shut down when the test ends
+func NewIssuer(t *testing.T) *Issuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating the signing key: %v", err)
+	}
+
+	issuer := &Issuer{key: key, codes: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.handleDiscovery)
+	mux.HandleFunc("GET /jwks", issuer.handleJWKS)
+	mux.HandleFunc("POST /token", issuer.handleToken)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// Config returns the configuration of a provider named name that logs in through the issuer
+func (i *Issuer) Config(name, redirectURL string) oidc.Config {
+	return oidc.Config{
+		Name:         name,
+		ClientID:     ClientID,
+		ClientSecret: ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email"},
+		Issuer:       i.URL,
+	}
+}
+
+// Authorize approves the authorization request in authURL as login
+// It returns the code and state the provider would send back to the redirect URL.
+func (i *Issuer) Authorize(t *testing.T, authURL string, login Login) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorization URL: %v", err)
+	}
+	q := u.Query()
+	if got := q.Get("client_id"); got != ClientID {
+		t.Fatalf("authorization request for client %q, want %q", got, ClientID)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without an S256 PKCE challenge: %s", authURL)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.serial++
+	code = "code-" + strconv.Itoa(i.serial)
+	i.codes[code] = grant{
+		login:       login,
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	return code, q.Get("state")
+}
+
+func (i *Issuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 i.URL,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"jwks_uri":               i.URL + "/jwks",
+	})
+}
+
+func (i *Issuer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := i.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": keyID,
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// handleToken redeems a code once, checking the client credentials, redirect URI and PKCE verifier
+func (i *Issuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if r.PostForm.Get("client_id") != ClientID || r.PostForm.Get("client_secret") != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	i.mu.Lock()
+	g, ok := i.codes[r.PostForm.Get("code")]
+	delete(i.codes, r.PostForm.Get("code"))
+	i.mu.Unlock()
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("redirect_uri") != g.redirectURI ||
+		oidc.CodeChallenge(r.PostForm.Get("code_verifier")) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	nonce := g.nonce
+	if g.login.Nonce != "" {
+		nonce = g.login.Nonce
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            i.URL,
+		"aud":            ClientID,
+		"sub":            g.login.Subject,
+		"email":          g.login.Email,
+		"email_verified": g.login.EmailVerified,
+		"nonce":          nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(i.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": "access-" + g.login.Subject,
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,360 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Config describes an OAuth2 / OpenID Connect provider
+// Providers with an Issuer are configured through discovery and must return an ID token.
+// Providers without one (GitHub) are plain OAuth2 and identify the user through UserInfoURL.
+type Config struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	Issuer      string
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	// EmailsURL lists the user's addresses when the userinfo response has no verified email (GitHub)
+	EmailsURL string
+}
+
+// Identity is the external account a login resolved to
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// Provider runs the authorization code flow against a single provider
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu         sync.Mutex
+	discovered bool
+	jwksURL    string
+	keys       map[string]*rsa.PublicKey
+	keysAt     time.Time
+}
+
+// NewProvider creates a Provider; discovery is deferred until the first login
+func NewProvider(cfg Config) *Provider {
+	return &Provider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name returns the provider name used in routes and stored identities
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+// discover fills in endpoints from the issuer's discovery document
+func (p *Provider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovered || p.cfg.Issuer == "" {
+		return nil
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, "", &doc); err != nil {
+		return fmt.Errorf("error fetching discovery document: %w", err)
+	}
+	if doc.Issuer != p.cfg.Issuer {
+		return fmt.Errorf("discovery issuer %q does not match configured issuer %q", doc.Issuer, p.cfg.Issuer)
+	}
+
+	if p.cfg.AuthURL == "" {
+		p.cfg.AuthURL = doc.AuthorizationEndpoint
+	}
+	if p.cfg.TokenURL == "" {
+		p.cfg.TokenURL = doc.TokenEndpoint
+	}
+	if p.cfg.UserInfoURL == "" {
+		p.cfg.UserInfoURL = doc.UserInfoEndpoint
+	}
+	p.jwksURL = doc.JWKSURI
+	p.discovered = true
+	return nil
+}
+
+// AuthCodeURL returns the URL to send the browser to
+// state and nonce are echoed back and must be checked by the caller; codeChallenge is the S256 PKCE challenge
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	if err := p.discover(ctx); err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	if p.cfg.Issuer != "" {
+		params.Set("nonce", nonce)
+	}
+
+	sep := "?"
+	if strings.Contains(p.cfg.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.cfg.AuthURL + sep + params.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified identity
+// For OIDC providers the ID token's signature, issuer, audience, expiry and nonce are all checked
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (Identity, error) {
+	if err := p.discover(ctx); err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {p.cfg.ClientSecret},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+	}
+	if err := p.doJSON(req, &tok); err != nil {
+		return Identity{}, fmt.Errorf("error exchanging code: %w", err)
+	}
+	if tok.Error != "" {
+		return Identity{}, fmt.Errorf("error exchanging code: %s", tok.Error)
+	}
+
+	if p.cfg.Issuer != "" {
+		if tok.IDToken == "" {
+			return Identity{}, errors.New("provider did not return an id_token")
+		}
+		return p.verifyIDToken(ctx, tok.IDToken, nonce)
+	}
+
+	if tok.AccessToken == "" {
+		return Identity{}, errors.New("provider did not return an access_token")
+	}
+	return p.userInfo(ctx, tok.AccessToken)
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, raw, nonce string) (Identity, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	})
+	if err != nil || !token.Valid {
+		return Identity{}, fmt.Errorf("invalid id_token: %v", err)
+	}
+
+	now := time.Now().Unix()
+	if !claims.VerifyIssuer(p.cfg.Issuer, true) {
+		return Identity{}, errors.New("id_token issuer mismatch")
+	}
+	if !claims.VerifyAudience(p.cfg.ClientID, true) {
+		return Identity{}, errors.New("id_token audience mismatch")
+	}
+	if !claims.VerifyExpiresAt(now, true) {
+		return Identity{}, errors.New("id_token expired")
+	}
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return Identity{}, errors.New("id_token nonce mismatch")
+	}
+
+	id := Identity{Provider: p.cfg.Name}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.EmailVerified = truthy(claims["email_verified"])
+	if id.Subject == "" {
+		return Identity{}, errors.New("id_token has no subject")
+	}
+	return id, nil
+}
+
+// userInfo identifies the user of a plain OAuth2 provider from its userinfo endpoint
+func (p *Provider) userInfo(ctx context.Context, accessToken string) (Identity, error) {
+	var info map[string]interface{}
+	if err := p.getJSON(ctx, p.cfg.UserInfoURL, accessToken, &info); err != nil {
+		return Identity{}, fmt.Errorf("error fetching user info: %w", err)
+	}
+
+	id := Identity{Provider: p.cfg.Name}
+	switch sub := info["sub"].(type) {
+	case string:
+		id.Subject = sub
+	}
+	if id.Subject == "" {
+		if n, ok := info["id"].(float64); ok {
+			id.Subject = strconv.FormatInt(int64(n), 10)
+		}
+	}
+	if id.Subject == "" {
+		return Identity{}, errors.New("user info has no subject")
+	}
+	id.Email, _ = info["email"].(string)
+	id.EmailVerified = truthy(info["email_verified"])
+
+	if !id.EmailVerified && p.cfg.EmailsURL != "" {
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if err := p.getJSON(ctx, p.cfg.EmailsURL, accessToken, &emails); err != nil {
+			return Identity{}, fmt.Errorf("error fetching user emails: %w", err)
+		}
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				id.Email = e.Email
+				id.EmailVerified = true
+				break
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// publicKey returns the signing key with the given ID, refreshing the JWKS when it is unknown
+func (p *Provider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.keysAt) > time.Minute
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale && p.keys != nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURL, "", &set); err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysAt = time.Now()
+	p.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, rawURL, bearer string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return p.doJSON(req, v)
+}
+
+func (p *Provider) doJSON(req *http.Request, v interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// truthy accepts both boolean and string forms of a claim, since providers disagree
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case string:
+		return b == "true"
+	}
+	return false
+}
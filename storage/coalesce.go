@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// CallStats counts the calls that went through a callGroup
+type CallStats struct {
+	// Executed calls did the work themselves
+	Executed int64 `json:"executed"`
+	// Coalesced calls waited for the result of an identical call already in flight
+	Coalesced int64 `json:"coalesced"`
+}
+
+// callGroup deduplicates concurrent calls with the same key, in the manner of
+// golang.org/x/sync/singleflight, while counting how many calls were saved
+// The zero value is ready to use.
+type callGroup struct {
+	mu    sync.Mutex
+	calls map[string]*call
+
+	executed  atomic.Int64
+	coalesced atomic.Int64
+}
+
+type call struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+
+	// waiters counts the callers still waiting for the result, guarded by the group's mu
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do runs fn once for all callers that ask for key while it is running and hands each of them the result
+// fn runs detached from any one caller's cancellation, since others may still be waiting on it; a caller
+// whose ctx ends stops waiting, and once the last one has left fn's context is cancelled.
+func (g *callGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		g.coalesced.Add(1)
+		return g.wait(ctx, key, c)
+	}
+
+	callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c := &call{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	g.calls[key] = c
+	g.mu.Unlock()
+	g.executed.Add(1)
+
+	go func() {
+		defer func() {
+			// Without this a panic would take down the process rather than the request
+			if r := recover(); r != nil {
+				c.err = fmt.Errorf("panic: %v", r)
+			}
+			g.mu.Lock()
+			g.forgetLocked(key, c)
+			g.mu.Unlock()
+			c.cancel()
+			close(c.done)
+		}()
+		c.val, c.err = fn(callCtx)
+	}()
+
+	return g.wait(ctx, key, c)
+}
+
+// wait returns the result of c, or gives up when ctx ends, cancelling c if nobody else is waiting
+func (g *callGroup) wait(ctx context.Context, key string, c *call) (interface{}, error) {
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	c.waiters--
+	abandoned := c.waiters == 0
+	if abandoned {
+		// Taken out under the same lock, so later callers start afresh rather than join a cancelled call
+		g.forgetLocked(key, c)
+	}
+	g.mu.Unlock()
+	if abandoned {
+		c.cancel()
+	}
+	return nil, ctx.Err()
+}
+
+// forgetLocked removes c from the calls in flight, unless a newer call for key has replaced it
+// g.mu must be held.
+func (g *callGroup) forgetLocked(key string, c *call) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+// Stats returns the counters accumulated since start
+func (g *callGroup) Stats() CallStats {
+	return CallStats{Executed: g.executed.Load(), Coalesced: g.coalesced.Load()}
+}
+
+// generations counts the invalidations of each user's cached listings, so that a listing that
+// started before an invalidation can tell its result may be stale
+// The counters are per process: with a shared cache, invalidations on other instances aren't seen.
+// The zero value is ready to use.
+type generations struct {
+	mu sync.Mutex
+	m  map[string]uint64
+}
+
+// current returns the generation of the user's listings
+func (g *generations) current(userID string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.m[userID]
+}
+
+// bump starts a new generation of the user's listings
+func (g *generations) bump(userID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.m == nil {
+		g.m = make(map[string]uint64)
+	}
+	g.m[userID]++
+}
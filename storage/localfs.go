@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+	"github.com/alvarofc/mode/utils"
+)
+
+var (
+	// ErrInvalidKey is returned for keys that would escape the storage root
+	ErrInvalidKey = errors.New("invalid object key")
+	// ErrInvalidSignature is returned for local file URLs that are forged or expired
+	ErrInvalidSignature = errors.New("invalid or expired file signature")
+)
+
+// LocalFS implements S3 on top of a directory, for development and tests without an S3 endpoint
+// Keys map to paths under the root directory and the file mtime stands in for LastModified.
+// Instead of presigned URLs it hands out HMAC-signed links to baseURL, which the API serves itself.
+type LocalFS struct {
+	root    string
+	baseURL string
+	secret  []byte
+	// URLTTL is how long listed links stay valid
+	URLTTL time.Duration
+}
+
+// NewLocalFS creates the root directory if needed and returns a LocalFS serving links under baseURL
+func NewLocalFS(root, baseURL string, secret []byte) (*LocalFS, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("local storage needs a signing secret")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating storage directory: %w", err)
+	}
+
+	return &LocalFS{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+		URLTTL:  DefaultURLConfig.TTL,
+	}, nil
+}
+
+// path resolves a key to a file under the root, rejecting keys such as "../x" or "/etc/passwd"
+func (l *LocalFS) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// WritePhoto stores data under key with the given modification time
+func (l *LocalFS) WritePhoto(key string, data []byte, modified time.Time) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		return err
+	}
+	return os.Chtimes(p, modified, modified)
+}
+
+// UploadPhoto stores a photo under user_<id>/<name>
+// Listings are read from disk on every call, so there is no cache to invalidate.
+func (l *LocalFS) UploadPhoto(ctx context.Context, userID, name string, data []byte) (types.ImageInfo, error) {
+	key := fmt.Sprintf("user_%s/%s", userID, name)
+	now := time.Now()
+	if err := l.WritePhoto(key, data, now); err != nil {
+		return types.ImageInfo{}, fmt.Errorf("error uploading photo: %w", err)
+	}
+	return types.ImageInfo{Key: key, Size: int64(len(data)), Modified: now}, nil
+}
+
+// movePhoto renames the file for key from to key to, creating directories as needed
+func (l *LocalFS) movePhoto(from, to string) error {
+	src, err := l.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := l.path(to)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+		return ErrPhotoNotFound
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func (l *LocalFS) TrashPhoto(ctx context.Context, userID, key string) error {
+	return l.movePhoto(key, TrashPrefix+key)
+}
+
+func (l *LocalFS) RestorePhoto(ctx context.Context, userID, key string) error {
+	return l.movePhoto(TrashPrefix+key, key)
+}
+
+func (l *LocalFS) PurgePhoto(ctx context.Context, key string) error {
+	trashed, err := l.path(TrashPrefix + key)
+	if err != nil {
+		return err
+	}
+	derivatives, err := l.path(DerivativesPrefix + key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(trashed); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.RemoveAll(derivatives)
+}
+
+// PurgeUser removes the directories of a user's photos, trash and derivatives
+func (l *LocalFS) PurgeUser(ctx context.Context, userID string) error {
+	user := fmt.Sprintf("user_%s", userID)
+	for _, prefix := range []string{user, TrashPrefix + user, DerivativesPrefix + user} {
+		dir, err := l.path(prefix)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LocalFS) DownloadPhotoByKey(ctx context.Context, key string) ([]byte, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (l *LocalFS) DownloadSmallPhotoByKey(ctx context.Context, key string) ([]byte, error) {
+	pngData, err := l.DownloadPhotoByKey(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("error getting original PNG: %w", err)
+	}
+
+	return resizePhoto(pngData)
+}
+
+// WalkPhotos calls fn for each image under user_<id>/ as the directory is read
+func (l *LocalFS) WalkPhotos(ctx context.Context, userID string, fn func(types.ImageInfo) error) error {
+	dir, err := l.path(fmt.Sprintf("user_%s", userID))
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || !utils.IsImage(p) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		fnErr = fn(types.ImageInfo{
+			Key:      filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("error listing objects: %w", err)
+	}
+	return nil
+}
+
+// OpenPhoto opens the file of a photo for reading
+func (l *LocalFS) OpenPhoto(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrPhotoNotFound
+	}
+	return f, err
+}
+
+// listPhotos returns the images under user_<id>/, newest first
+func (l *LocalFS) listPhotos(ctx context.Context, userID string, limit int64) ([]types.ImageInfo, error) {
+	var images []types.ImageInfo
+	err := l.WalkPhotos(ctx, userID, func(image types.ImageInfo) error {
+		images = append(images, image)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Modified.After(images[j].Modified)
+	})
+
+	if limit > 0 && int64(len(images)) > limit {
+		images = images[:limit]
+	}
+
+	return images, nil
+}
+
+func (l *LocalFS) GetLastXPhotosForUser(ctx context.Context, userID string, photoNum int64) ([]types.ImageInfo, error) {
+	images, err := l.listPhotos(ctx, userID, photoNum)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no image files found for user %s", userID)
+	}
+
+	for i := range images {
+		images[i].URL, images[i].URLExpires, _ = l.PresignURL(ctx, images[i].Key, l.URLTTL)
+	}
+	return images, nil
+}
+
+func (l *LocalFS) GetLastPhotoForUser(ctx context.Context, userID string) (types.ImageInfo, error) {
+	images, err := l.GetLastXPhotosForUser(ctx, userID, 1)
+	if err != nil {
+		return types.ImageInfo{}, err
+	}
+	return images[0], nil
+}
+
+func (l *LocalFS) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, l.secret)
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURL returns a link to key under baseURL that stays valid for ttl
+func (l *LocalFS) SignedURL(key string, ttl time.Duration) string {
+	return l.signedURL(key, time.Now().Add(ttl).Unix())
+}
+
+func (l *LocalFS) signedURL(key string, expires int64) string {
+	var escaped []string
+	for _, part := range strings.Split(key, "/") {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", l.signature(key, expires))
+	return l.baseURL + "/" + strings.Join(escaped, "/") + "?" + query.Encode()
+}
+
+// PresignURL is SignedURL with the expiry, so LocalFS can stand in for S3Client
+func (l *LocalFS) PresignURL(ctx context.Context, key string, ttl time.Duration) (string, time.Time, error) {
+	if ttl == 0 {
+		ttl = l.URLTTL
+	}
+	expires := time.Now().Add(ttl).Unix()
+	return l.signedURL(key, expires), time.Unix(expires, 0), nil
+}
+
+// VerifySignedURL checks the expires and signature query parameters of a link made by SignedURL
+func (l *LocalFS) VerifySignedURL(key string, query url.Values) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(l.signature(key, expires))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
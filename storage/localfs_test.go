@@ -0,0 +1,11 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/alvarofc/mode/storage/s3test"
+)
+
+func TestLocalFS(t *testing.T) {
+	s3test.Run(t, s3test.LocalFS)
+}
@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Memory is an in-process implementation of Storage for tests and single-node use
+// It mirrors the Postgres semantics (case-insensitively unique emails, bcrypt hashing, sql.ErrNoRows for
+// missing rows) but keeps everything in memory, so data is lost on restart.
+type Memory struct {
+	mu sync.Mutex
+
+	nextUserID    int
+	users         map[int]*types.User
+	tokens        map[string]*memoryToken
+	identities    map[string]*memoryIdentity
+	recoveryCodes map[int][]*memoryRecoveryCode
+	totpSteps     map[int]int64
+	photos        map[string]*memoryPhoto
+	nextAlbumID   int
+	albums        map[int]*memoryAlbum
+	nextShareID   int
+	shares        map[int]*types.Share
+	nextExportID  int
+	exports       map[int]*types.Export
+	deletions     []*types.AccountDeletion
+}
+
+type memoryToken struct {
+	userID    int
+	purpose   string
+	expiresAt time.Time
+	used      bool
+}
+
+type memoryIdentity struct {
+	userID int
+	types.Identity
+}
+
+type memoryRecoveryCode struct {
+	hash string
+	used bool
+}
+
+type memoryPhoto struct {
+	userID    int
+	size      int64
+	createdAt time.Time
+	deletedAt *time.Time
+	meta      types.PhotoMetadata
+	hash      *uint64
+	checksum  string
+	image     *types.ImageMetadata
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		users:         make(map[int]*types.User),
+		tokens:        make(map[string]*memoryToken),
+		identities:    make(map[string]*memoryIdentity),
+		recoveryCodes: make(map[int][]*memoryRecoveryCode),
+		totpSteps:     make(map[int]int64),
+		photos:        make(map[string]*memoryPhoto),
+		albums:        make(map[int]*memoryAlbum),
+		shares:        make(map[int]*types.Share),
+		exports:       make(map[int]*types.Export),
+	}
+}
+
+func identityKey(provider, subject string) string {
+	return provider + "\x00" + subject
+}
+
+func (m *Memory) userByEmail(email string) *types.User {
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (m *Memory) GetUserById(ctx context.Context, id int) (types.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return types.User{}, sql.ErrNoRows
+	}
+	// Like the Postgres query, lookups by ID don't return the password hash
+	user := *u
+	user.Password = ""
+	return user, nil
+}
+
+func (m *Memory) GetUserByEmail(ctx context.Context, email string) (types.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.userByEmail(email)
+	if u == nil {
+		return types.User{}, sql.ErrNoRows
+	}
+	return *u, nil
+}
+
+func (m *Memory) CreateUser(ctx context.Context, email, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.userByEmail(email) != nil {
+		return ErrDuplicateEmail
+	}
+	m.nextUserID++
+	m.users[m.nextUserID] = &types.User{
+		ID:            m.nextUserID,
+		Email:         email,
+		Password:      string(hashedPassword),
+		StripMetadata: true,
+	}
+	return nil
+}
+
+func (m *Memory) UpdatePassword(ctx context.Context, userID int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.Password = string(hashedPassword)
+		u.PasswordChangedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *Memory) MarkEmailVerified(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.EmailVerified = true
+	}
+	return nil
+}
+
+func (m *Memory) SetStripMetadata(ctx context.Context, userID int, strip bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.StripMetadata = strip
+	return nil
+}
+
+func (m *Memory) CreateAccountToken(ctx context.Context, userID int, purpose, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return errors.New("user does not exist")
+	}
+	if _, exists := m.tokens[tokenHash]; exists {
+		return errors.New("duplicate token")
+	}
+	m.tokens[tokenHash] = &memoryToken{userID: userID, purpose: purpose, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *Memory) ConsumeAccountToken(ctx context.Context, purpose, tokenHash string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[tokenHash]
+	if !ok || t.purpose != purpose || t.used || !time.Now().Before(t.expiresAt) {
+		return 0, sql.ErrNoRows
+	}
+	t.used = true
+	return t.userID, nil
+}
+
+func (m *Memory) DeleteAccountTokens(ctx context.Context, userID int, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, t := range m.tokens {
+		if t.userID == userID && t.purpose == purpose && !t.used {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) GetUserByIdentity(ctx context.Context, provider, subject string) (types.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	identity, ok := m.identities[identityKey(provider, subject)]
+	if !ok {
+		return types.User{}, sql.ErrNoRows
+	}
+	u, ok := m.users[identity.userID]
+	if !ok {
+		return types.User{}, sql.ErrNoRows
+	}
+	return *u, nil
+}
+
+func (m *Memory) LinkIdentity(ctx context.Context, userID int, provider, subject, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return errors.New("user does not exist")
+	}
+	key := identityKey(provider, subject)
+	if _, exists := m.identities[key]; exists {
+		return errors.New("identity is already linked")
+	}
+	m.identities[key] = &memoryIdentity{
+		userID:   userID,
+		Identity: types.Identity{Provider: provider, Subject: subject, Email: email, CreatedAt: time.Now()},
+	}
+	return nil
+}
+
+func (m *Memory) SetTOTPSecret(ctx context.Context, userID int, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.TOTPSecret = secret
+		u.TOTPEnabled = false
+	}
+	return nil
+}
+
+func (m *Memory) EnableTOTP(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[userID]; ok && u.TOTPSecret != "" {
+		u.TOTPEnabled = true
+	}
+	return nil
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, userID int, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	if last, ok := m.totpSteps[userID]; ok && last >= step {
+		return sql.ErrNoRows
+	}
+	m.totpSteps[userID] = step
+	return nil
+}
+
+func (m *Memory) DisableTOTP(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.TOTPSecret = ""
+		u.TOTPEnabled = false
+	}
+	delete(m.recoveryCodes, userID)
+	return nil
+}
+
+func (m *Memory) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return errors.New("user does not exist")
+	}
+	codes := make([]*memoryRecoveryCode, len(codeHashes))
+	for i, hash := range codeHashes {
+		codes[i] = &memoryRecoveryCode{hash: hash}
+	}
+	m.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (m *Memory) UseRecoveryCode(ctx context.Context, userID int, codeHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.recoveryCodes[userID] {
+		if c.hash == codeHash && !c.used {
+			c.used = true
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *Memory) CreatePhoto(ctx context.Context, userID int, key string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return errors.New("user does not exist")
+	}
+	if _, exists := m.photos[key]; exists {
+		return errors.New("photo already exists")
+	}
+	m.photos[key] = &memoryPhoto{
+		userID:    userID,
+		size:      size,
+		createdAt: time.Now(),
+		meta:      types.PhotoMetadata{Source: types.PhotoSourceUpload},
+	}
+	return nil
+}
+
+func (m *Memory) TrashPhoto(ctx context.Context, userID int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	photo, ok := m.photos[key]
+	if !ok {
+		if _, ok := m.users[userID]; !ok {
+			return errors.New("user does not exist")
+		}
+		m.photos[key] = &memoryPhoto{
+			userID:    userID,
+			createdAt: now,
+			deletedAt: &now,
+			meta:      types.PhotoMetadata{Source: types.PhotoSourceUpload},
+		}
+		return nil
+	}
+	if photo.userID == userID {
+		photo.deletedAt = &now
+	}
+	return nil
+}
+
+func (m *Memory) RestorePhoto(ctx context.Context, userID int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	photo, ok := m.photos[key]
+	if !ok || photo.userID != userID || photo.deletedAt == nil {
+		return sql.ErrNoRows
+	}
+	photo.deletedAt = nil
+	return nil
+}
+
+func (m *Memory) trashed(match func(key string, photo *memoryPhoto) bool) []types.TrashedPhoto {
+	var photos []types.TrashedPhoto
+	for key, photo := range m.photos {
+		if photo.deletedAt != nil && match(key, photo) {
+			photos = append(photos, types.TrashedPhoto{
+				Key:       key,
+				UserID:    photo.userID,
+				Size:      photo.size,
+				DeletedAt: *photo.deletedAt,
+			})
+		}
+	}
+	return photos
+}
+
+func (m *Memory) ListTrash(ctx context.Context, userID int) ([]types.TrashedPhoto, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	photos := m.trashed(func(key string, photo *memoryPhoto) bool {
+		return photo.userID == userID
+	})
+	sort.Slice(photos, func(i, j int) bool {
+		return photos[i].DeletedAt.After(photos[j].DeletedAt)
+	})
+	return photos, nil
+}
+
+func (m *Memory) ExpiredTrash(ctx context.Context, before time.Time, limit int) ([]types.TrashedPhoto, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	photos := m.trashed(func(key string, photo *memoryPhoto) bool {
+		return photo.deletedAt.Before(before)
+	})
+	sort.Slice(photos, func(i, j int) bool {
+		return photos[i].DeletedAt.Before(photos[j].DeletedAt)
+	})
+	if len(photos) > limit {
+		photos = photos[:limit]
+	}
+	return photos, nil
+}
+
+func (m *Memory) DeletePhoto(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.photos, key)
+	for _, album := range m.albums {
+		album.remove(key)
+	}
+	return nil
+}
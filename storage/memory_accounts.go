@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+)
+
+func (m *Memory) ListIdentities(ctx context.Context, userID int) ([]types.Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var identities []types.Identity
+	for _, identity := range m.identities {
+		if identity.userID == userID {
+			identities = append(identities, identity.Identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		if !identities[i].CreatedAt.Equal(identities[j].CreatedAt) {
+			return identities[i].CreatedAt.Before(identities[j].CreatedAt)
+		}
+		return identities[i].Provider < identities[j].Provider
+	})
+	return identities, nil
+}
+
+// DeleteUser removes everything that references the user, as the foreign keys do in Postgres
+func (m *Memory) DeleteUser(ctx context.Context, userID int) (types.AccountDeletion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return types.AccountDeletion{}, sql.ErrNoRows
+	}
+	deletion := &types.AccountDeletion{ID: len(m.deletions) + 1, UserID: userID, DeletedAt: time.Now()}
+
+	for key, photo := range m.photos {
+		if photo.userID == userID {
+			deletion.Photos++
+			delete(m.photos, key)
+		}
+	}
+	for id, album := range m.albums {
+		if album.userID == userID {
+			deletion.Albums++
+			delete(m.albums, id)
+		}
+	}
+	for id, share := range m.shares {
+		if share.UserID == userID {
+			deletion.Shares++
+			delete(m.shares, id)
+		}
+	}
+	for id, export := range m.exports {
+		if export.UserID == userID {
+			delete(m.exports, id)
+		}
+	}
+	for hash, token := range m.tokens {
+		if token.userID == userID {
+			delete(m.tokens, hash)
+		}
+	}
+	for key, identity := range m.identities {
+		if identity.userID == userID {
+			delete(m.identities, key)
+		}
+	}
+	delete(m.recoveryCodes, userID)
+	delete(m.totpSteps, userID)
+	delete(m.users, userID)
+
+	m.deletions = append(m.deletions, deletion)
+	return *deletion, nil
+}
+
+func (m *Memory) PendingAccountPurges(ctx context.Context, limit int) ([]types.AccountDeletion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deletions []types.AccountDeletion
+	for _, deletion := range m.deletions {
+		if deletion.ObjectsPurgedAt == nil && len(deletions) < limit {
+			deletions = append(deletions, *deletion)
+		}
+	}
+	return deletions, nil
+}
+
+func (m *Memory) MarkAccountPurged(ctx context.Context, deletionID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, deletion := range m.deletions {
+		if deletion.ID == deletionID && deletion.ObjectsPurgedAt == nil {
+			now := time.Now()
+			deletion.ObjectsPurgedAt = &now
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+)
+
+type memoryAlbum struct {
+	userID    int
+	name      string
+	coverKey  string
+	createdAt time.Time
+	// keys are the album's photos in order
+	keys    []string
+	addedAt map[string]time.Time
+}
+
+func (a *memoryAlbum) remove(key string) bool {
+	i := slices.Index(a.keys, key)
+	if i < 0 {
+		return false
+	}
+	a.keys = slices.Delete(a.keys, i, i+1)
+	delete(a.addedAt, key)
+	if a.coverKey == key {
+		a.coverKey = ""
+	}
+	return true
+}
+
+// album returns the album if userID owns it
+func (m *Memory) album(userID, albumID int) (*memoryAlbum, error) {
+	album, ok := m.albums[albumID]
+	if !ok || album.userID != userID {
+		return nil, sql.ErrNoRows
+	}
+	return album, nil
+}
+
+// visibleKeys leaves out the album photos that are in the trash or aren't the owner's catalogued photos
+func (m *Memory) visibleKeys(album *memoryAlbum) []string {
+	var keys []string
+	for _, key := range album.keys {
+		if m.ownedPhoto(album.userID, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ownedPhoto reports whether key is a catalogued photo of the user that isn't in the trash
+func (m *Memory) ownedPhoto(userID int, key string) bool {
+	photo, ok := m.photos[key]
+	return ok && photo.userID == userID && photo.deletedAt == nil
+}
+
+func (m *Memory) albumInfo(id int, album *memoryAlbum) types.Album {
+	return types.Album{
+		ID:         id,
+		UserID:     album.userID,
+		Name:       album.name,
+		CoverKey:   album.coverKey,
+		PhotoCount: len(m.visibleKeys(album)),
+		CreatedAt:  album.createdAt,
+	}
+}
+
+func (m *Memory) CreateAlbum(ctx context.Context, userID int, name string) (types.Album, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return types.Album{}, errors.New("user does not exist")
+	}
+	m.nextAlbumID++
+	album := &memoryAlbum{userID: userID, name: name, createdAt: time.Now(), addedAt: make(map[string]time.Time)}
+	m.albums[m.nextAlbumID] = album
+	return m.albumInfo(m.nextAlbumID, album), nil
+}
+
+func (m *Memory) ListAlbums(ctx context.Context, userID int) ([]types.Album, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var albums []types.Album
+	for id, album := range m.albums {
+		if album.userID == userID {
+			albums = append(albums, m.albumInfo(id, album))
+		}
+	}
+	slices.SortFunc(albums, func(a, b types.Album) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return albums, nil
+}
+
+func (m *Memory) GetAlbum(ctx context.Context, userID, albumID int) (types.Album, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.album(userID, albumID)
+	if err != nil {
+		return types.Album{}, err
+	}
+	return m.albumInfo(albumID, album), nil
+}
+
+func (m *Memory) RenameAlbum(ctx context.Context, userID, albumID int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.album(userID, albumID)
+	if err != nil {
+		return err
+	}
+	album.name = name
+	return nil
+}
+
+func (m *Memory) DeleteAlbum(ctx context.Context, userID, albumID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.album(userID, albumID); err != nil {
+		return err
+	}
+	delete(m.albums, albumID)
+	for id, share := range m.shares {
+		if share.AlbumID == albumID {
+			delete(m.shares, id)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) SetAlbumCover(ctx context.Context, userID, albumID int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.album(userID, albumID)
+	if err != nil {
+		return err
+	}
+	if key != "" && (!slices.Contains(album.keys, key) || !m.ownedPhoto(userID, key)) {
+		return sql.ErrNoRows
+	}
+	album.coverKey = key
+	return nil
+}
+
+func (m *Memory) AddAlbumPhotos(ctx context.Context, userID, albumID int, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.album(userID, albumID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !m.ownedPhoto(userID, key) {
+			return ErrPhotoNotFound
+		}
+	}
+	for _, key := range keys {
+		if _, exists := album.addedAt[key]; !exists {
+			album.keys = append(album.keys, key)
+			album.addedAt[key] = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *Memory) RemoveAlbumPhoto(ctx context.Context, userID, albumID int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.album(userID, albumID)
+	if err != nil {
+		return err
+	}
+	if !album.remove(key) {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (m *Memory) ReorderAlbumPhotos(ctx context.Context, userID, albumID int, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.album(userID, albumID)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool, len(album.keys))
+	for _, key := range album.keys {
+		current[key] = true
+	}
+	if !samePhotoSet(current, keys) {
+		return ErrInvalidOrder
+	}
+	album.keys = slices.Clone(keys)
+	return nil
+}
+
+func (m *Memory) AlbumPhotos(ctx context.Context, userID, albumID int) ([]types.ImageInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.album(userID, albumID)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []types.ImageInfo{}
+	for _, key := range m.visibleKeys(album) {
+		photo := m.photos[key]
+		images = append(images, types.ImageInfo{Key: key, Size: photo.size, Modified: photo.createdAt})
+	}
+	return images, nil
+}
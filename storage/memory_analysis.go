@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"math/bits"
+	"sort"
+
+	"github.com/alvarofc/mode/types"
+)
+
+func (m *Memory) SetPhotoHash(ctx context.Context, key string, hash uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	photo, ok := m.photos[key]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	photo.hash = &hash
+	return nil
+}
+
+func (m *Memory) SimilarPhotos(ctx context.Context, userID int, hash uint64, maxDistance, limit int) ([]types.SimilarPhoto, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var photos []types.SimilarPhoto
+	for key, photo := range m.photos {
+		if photo.userID != userID || photo.deletedAt != nil || photo.hash == nil {
+			continue
+		}
+		distance := bits.OnesCount64(*photo.hash ^ hash)
+		if distance > maxDistance {
+			continue
+		}
+		photos = append(photos, types.SimilarPhoto{
+			ImageInfo: types.ImageInfo{Key: key, Size: photo.size, Modified: photo.createdAt},
+			Distance:  distance,
+		})
+	}
+
+	sort.Slice(photos, func(i, j int) bool {
+		if photos[i].Distance != photos[j].Distance {
+			return photos[i].Distance < photos[j].Distance
+		}
+		return photos[i].Modified.After(photos[j].Modified)
+	})
+	if len(photos) > limit {
+		photos = photos[:limit]
+	}
+	return photos, nil
+}
+
+func (m *Memory) SetPhotoChecksum(ctx context.Context, key, checksum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	photo, ok := m.photos[key]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	photo.checksum = checksum
+	return nil
+}
+
+func (m *Memory) PhotoWithChecksum(ctx context.Context, userID int, checksum string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, photo := range m.photos {
+		if photo.userID == userID && photo.deletedAt == nil && photo.checksum != "" && photo.checksum == checksum {
+			return key, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (m *Memory) SetImageMetadata(ctx context.Context, key string, meta types.ImageMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	photo, ok := m.photos[key]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	photo.image = &meta
+	return nil
+}
+
+func (m *Memory) ImageMetadata(ctx context.Context, keys []string) (map[string]types.ImageMetadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metadata := make(map[string]types.ImageMetadata, len(keys))
+	for _, key := range keys {
+		if photo, ok := m.photos[key]; ok && photo.image != nil {
+			metadata[key] = *photo.image
+		}
+	}
+	return metadata, nil
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+)
+
+func (m *Memory) CreateExport(ctx context.Context, userID int, expiresAt time.Time) (types.Export, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return types.Export{}, errors.New("user does not exist")
+	}
+	m.nextExportID++
+	export := types.Export{ID: m.nextExportID, UserID: userID, CreatedAt: time.Now(), ExpiresAt: expiresAt}
+	m.exports[export.ID] = &export
+	return export, nil
+}
+
+func (m *Memory) GetExport(ctx context.Context, userID, exportID int) (types.Export, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	export, ok := m.exports[exportID]
+	if !ok || export.UserID != userID {
+		return types.Export{}, sql.ErrNoRows
+	}
+	return *export, nil
+}
+
+func (m *Memory) CompleteExport(ctx context.Context, exportID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if export, ok := m.exports[exportID]; ok && export.CompletedAt == nil {
+		now := time.Now()
+		export.CompletedAt = &now
+	}
+	return nil
+}
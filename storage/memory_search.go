@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/alvarofc/mode/types"
+)
+
+func (m *Memory) details(key string, photo *memoryPhoto) types.PhotoDetails {
+	meta := photo.meta
+	meta.Tags = append([]string{}, meta.Tags...)
+	params := make(map[string]interface{}, len(meta.GenerationParams))
+	for k, v := range meta.GenerationParams {
+		params[k] = v
+	}
+	meta.GenerationParams = params
+
+	details := types.PhotoDetails{
+		ImageInfo:     types.ImageInfo{Key: key, Size: photo.size, Modified: photo.createdAt},
+		PhotoMetadata: meta,
+	}
+	if photo.hash != nil {
+		hash := *photo.hash
+		details.Hash = &hash
+	}
+	return details
+}
+
+func (m *Memory) GetPhoto(ctx context.Context, userID int, key string) (types.PhotoDetails, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	photo, ok := m.photos[key]
+	if !ok || photo.userID != userID || photo.deletedAt != nil {
+		return types.PhotoDetails{}, sql.ErrNoRows
+	}
+	return m.details(key, photo), nil
+}
+
+func (m *Memory) UpdatePhotoMetadata(ctx context.Context, userID int, key string, meta types.PhotoMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	photo, ok := m.photos[key]
+	if !ok || photo.userID != userID || photo.deletedAt != nil {
+		return sql.ErrNoRows
+	}
+	photo.meta = meta
+	return nil
+}
+
+// searchWords splits text into lowercase words
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '-'
+	})
+}
+
+// stem strips common English suffixes, a rough stand-in for the Postgres english dictionary
+func stem(word string) string {
+	for _, suffix := range []string{"ing", "ed", "es", "s"} {
+		if strings.HasSuffix(word, suffix) && len(word)-len(suffix) >= 3 {
+			return strings.TrimSuffix(word, suffix)
+		}
+	}
+	return word
+}
+
+// memoryRank approximates the Postgres ranking: every term must match a tag or a word of the
+// prompt, tags counting more, and terms prefixed with - must match neither
+func memoryRank(text string, meta types.PhotoMetadata) (float64, bool) {
+	tags := make(map[string]bool, len(meta.Tags))
+	for _, tag := range meta.Tags {
+		tags[stem(strings.ToLower(tag))] = true
+	}
+	prompt := searchWords(meta.Prompt)
+
+	rank := 0.0
+	for _, term := range searchWords(text) {
+		exclude := strings.HasPrefix(term, "-")
+		term = strings.Trim(term, "-")
+		if term == "" {
+			continue
+		}
+
+		score := 0.0
+		if tags[stem(term)] {
+			score += 1
+		}
+		for _, word := range prompt {
+			if stem(word) == stem(term) {
+				score += 0.4
+				break
+			}
+		}
+
+		if exclude != (score == 0) {
+			return 0, false
+		}
+		rank += score
+	}
+	return rank, true
+}
+
+func (m *Memory) SearchPhotos(ctx context.Context, userID int, query PhotoQuery) ([]types.PhotoDetails, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var photos []types.PhotoDetails
+	for key, photo := range m.photos {
+		if photo.userID != userID || photo.deletedAt != nil ||
+			(!query.From.IsZero() && photo.createdAt.Before(query.From)) ||
+			(!query.To.IsZero() && !photo.createdAt.Before(query.To)) ||
+			(query.MinSize > 0 && photo.size < query.MinSize) ||
+			(query.MaxSize > 0 && photo.size > query.MaxSize) ||
+			(query.Source != "" && photo.meta.Source != query.Source) ||
+			!hasTags(photo.meta.Tags, query.Tags) {
+			continue
+		}
+
+		rank, ok := memoryRank(query.Text, photo.meta)
+		if !ok {
+			continue
+		}
+		details := m.details(key, photo)
+		details.Rank = rank
+		photos = append(photos, details)
+	}
+
+	sort.Slice(photos, func(i, j int) bool {
+		if photos[i].Rank != photos[j].Rank {
+			return photos[i].Rank > photos[j].Rank
+		}
+		return photos[i].Modified.After(photos[j].Modified)
+	})
+
+	if query.Offset >= len(photos) {
+		return nil, nil
+	}
+	photos = photos[query.Offset:]
+	if query.Limit > 0 && len(photos) > query.Limit {
+		photos = photos[:query.Limit]
+	}
+	return photos, nil
+}
+
+// hasTags reports whether tags contains every one of want
+func hasTags(tags, want []string) bool {
+	have := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		have[tag] = true
+	}
+	for _, tag := range want {
+		if !have[tag] {
+			return false
+		}
+	}
+	return true
+}
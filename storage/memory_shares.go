@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+)
+
+func (m *Memory) CreateShare(ctx context.Context, share types.Share) (types.Share, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[share.UserID]; !ok {
+		return types.Share{}, errors.New("user does not exist")
+	}
+	if (share.PhotoKey == "") == (share.AlbumID == 0) {
+		return types.Share{}, errors.New("a share needs either a photo or an album")
+	}
+	if share.AlbumID != 0 {
+		if _, ok := m.albums[share.AlbumID]; !ok {
+			return types.Share{}, errors.New("album does not exist")
+		}
+	}
+	for _, existing := range m.shares {
+		if existing.Slug == share.Slug {
+			return types.Share{}, errors.New("slug already exists")
+		}
+	}
+
+	m.nextShareID++
+	share.ID = m.nextShareID
+	share.CreatedAt = time.Now()
+	share.Downloads, share.Views = 0, 0
+	m.shares[share.ID] = &share
+	return share, nil
+}
+
+func (m *Memory) ListShares(ctx context.Context, userID int) ([]types.Share, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var shares []types.Share
+	for _, share := range m.shares {
+		if share.UserID == userID {
+			shares = append(shares, *share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].ID > shares[j].ID
+	})
+	return shares, nil
+}
+
+func (m *Memory) GetShare(ctx context.Context, slug string) (types.Share, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, share := range m.shares {
+		if share.Slug == slug {
+			return *share, nil
+		}
+	}
+	return types.Share{}, sql.ErrNoRows
+}
+
+func (m *Memory) DeleteShare(ctx context.Context, userID, shareID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, ok := m.shares[shareID]
+	if !ok || share.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(m.shares, shareID)
+	return nil
+}
+
+func (m *Memory) RecordShareView(ctx context.Context, shareID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, ok := m.shares[shareID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	share.Views++
+	return nil
+}
+
+func (m *Memory) RecordShareDownload(ctx context.Context, shareID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, ok := m.shares[shareID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		return ErrShareExhausted
+	}
+	share.Downloads++
+	return nil
+}
@@ -0,0 +1,10 @@
+CREATE TABLE photos (
+    key TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    size BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    deleted_at TIMESTAMPTZ
+);
+
+CREATE INDEX photos_user_id_idx ON photos (user_id, created_at DESC);
+CREATE INDEX photos_deleted_at_idx ON photos (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,20 @@
+CREATE TABLE albums (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    cover_key TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX albums_user_id_idx ON albums (user_id);
+
+-- photo_key has no foreign key: photos uploaded before the catalog existed can be added too
+CREATE TABLE album_photos (
+    album_id INTEGER NOT NULL REFERENCES albums (id) ON DELETE CASCADE,
+    photo_key TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (album_id, photo_key)
+);
+
+CREATE INDEX album_photos_photo_key_idx ON album_photos (photo_key);
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS photos_search_vector_update ON photos;
+DROP FUNCTION IF EXISTS photos_search_vector_update();
+ALTER TABLE photos DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE photos DROP COLUMN IF EXISTS tags;
+ALTER TABLE photos DROP COLUMN IF EXISTS generation_params;
+ALTER TABLE photos DROP COLUMN IF EXISTS prompt;
+ALTER TABLE photos DROP COLUMN IF EXISTS source;
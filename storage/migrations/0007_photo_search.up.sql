@@ -0,0 +1,23 @@
+ALTER TABLE photos ADD COLUMN source TEXT NOT NULL DEFAULT 'upload';
+ALTER TABLE photos ADD COLUMN prompt TEXT NOT NULL DEFAULT '';
+ALTER TABLE photos ADD COLUMN generation_params JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE photos ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE photos ADD COLUMN search_vector TSVECTOR NOT NULL DEFAULT ''::tsvector;
+
+-- Tags are indexed verbatim and rank above the stemmed prompt. A trigger is needed
+-- because array_to_string isn't immutable, which rules out a generated column.
+CREATE FUNCTION photos_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', array_to_string(NEW.tags, ' ')), 'A') ||
+        setweight(to_tsvector('english', NEW.prompt), 'B');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER photos_search_vector_update
+    BEFORE INSERT OR UPDATE OF tags, prompt ON photos
+    FOR EACH ROW EXECUTE FUNCTION photos_search_vector_update();
+
+CREATE INDEX photos_search_vector_idx ON photos USING GIN (search_vector);
+CREATE INDEX photos_tags_idx ON photos USING GIN (tags);
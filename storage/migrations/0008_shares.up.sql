@@ -0,0 +1,17 @@
+-- A share points at exactly one photo or album. photo_key has no foreign key, like album_photos.
+CREATE TABLE shares (
+    id SERIAL PRIMARY KEY,
+    slug TEXT NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    photo_key TEXT,
+    album_id INTEGER REFERENCES albums (id) ON DELETE CASCADE,
+    password_hash TEXT,
+    expires_at TIMESTAMPTZ,
+    max_downloads INTEGER,
+    downloads INTEGER NOT NULL DEFAULT 0,
+    views INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK ((photo_key IS NULL) <> (album_id IS NULL))
+);
+
+CREATE INDEX shares_user_id_idx ON shares (user_id);
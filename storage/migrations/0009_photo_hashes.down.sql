@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS photos_user_id_phash_idx;
+ALTER TABLE photos DROP COLUMN IF EXISTS phash;
@@ -0,0 +1,4 @@
+-- The 64-bit difference hash of the image, stored as signed. NULL until it has been computed.
+ALTER TABLE photos ADD COLUMN phash BIGINT;
+
+CREATE INDEX photos_user_id_phash_idx ON photos (user_id, phash);
@@ -0,0 +1,2 @@
+-- Dimensions, type, EXIF fields, palette and BlurHash extracted at upload, as types.ImageMetadata
+ALTER TABLE photos ADD COLUMN image_metadata JSONB;
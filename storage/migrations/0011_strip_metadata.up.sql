@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS strip_metadata BOOLEAN NOT NULL DEFAULT true;
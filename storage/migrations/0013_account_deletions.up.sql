@@ -0,0 +1,12 @@
+-- Outlives the user it describes, so user_id has no foreign key
+CREATE TABLE account_deletions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    photos INTEGER NOT NULL DEFAULT 0,
+    albums INTEGER NOT NULL DEFAULT 0,
+    shares INTEGER NOT NULL DEFAULT 0,
+    deleted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    objects_purged_at TIMESTAMPTZ
+);
+
+CREATE INDEX account_deletions_pending_idx ON account_deletions (deleted_at) WHERE objects_purged_at IS NULL;
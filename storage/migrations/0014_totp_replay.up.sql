@@ -0,0 +1,2 @@
+-- The time step of the last TOTP code accepted, so a code can't be replayed within its window
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS photos_user_id_sha256_idx;
+ALTER TABLE photos DROP COLUMN IF EXISTS sha256;
@@ -0,0 +1,5 @@
+-- The hex SHA-256 of the uploaded content, which identifies exact duplicates. NULL for photos
+-- uploaded before it was recorded.
+ALTER TABLE photos ADD COLUMN sha256 TEXT;
+
+CREATE INDEX photos_user_id_sha256_idx ON photos (user_id, sha256);
@@ -0,0 +1,14 @@
+-- Sign-up and sign-in lowercase addresses, so accounts created before that are lowercased too and
+-- lookups compare lower(email). Accounts whose addresses differ only in case have to be merged or
+-- renamed by hand first; the migration refuses to pick one.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM users GROUP BY lower(email) HAVING count(*) > 1) THEN
+        RAISE EXCEPTION 'several users share an email that differs only in case: %',
+            (SELECT string_agg(lower(email), ', ') FROM (SELECT lower(email) AS email FROM users GROUP BY lower(email) HAVING count(*) > 1) d);
+    END IF;
+END $$;
+
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+
+CREATE UNIQUE INDEX users_email_lower_idx ON users (lower(email));
@@ -0,0 +1,3 @@
+-- Sessions are stateless JWTs; those issued before the password last changed are refused.
+-- NULL until the password is first changed.
+ALTER TABLE users ADD COLUMN password_changed_at TIMESTAMPTZ;
@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/alvarofc/mode/types"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -13,45 +17,310 @@ type Postgres struct {
 	db *sql.DB
 }
 
-func NewPostgres(host, port, user, password, dbname string) (*Postgres, error) {
-	connectionString := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname,
-	)
+// NewPostgres opens the connection pool and waits for the database to accept connections
+// It retries with exponential backoff for up to cfg.ConnectTimeout, so the server can start alongside the database
+func NewPostgres(ctx context.Context, cfg PostgresConfig) (*Postgres, error) {
+	connectionString, err := cfg.dsn()
+	if err != nil {
+		return nil, err
+	}
 
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return nil, err
 	}
 
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
 	// Test the connection
-	err = db.Ping()
-	if err != nil {
-		return nil, err
+	ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+
+	delay := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = db.PingContext(ctx)
+		if err == nil {
+			break
+		}
+
+		log.Printf("Database not ready (attempt %d): %v", attempt, err)
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, fmt.Errorf("database unreachable after %d attempts: %w", attempt, err)
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
 	}
 
 	return &Postgres{db: db}, nil
 }
 
-func (p *Postgres) GetUserById(id int) (types.User, error) {
-	row := p.db.QueryRow("SELECT * FROM users WHERE id = $1", id)
+// Close closes the connection pool
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
+
+// Stats returns connection pool statistics for monitoring
+func (p *Postgres) Stats() sql.DBStats {
+	return p.db.Stats()
+}
+
+func (p *Postgres) GetUserById(ctx context.Context, id int) (types.User, error) {
+	row := p.db.QueryRowContext(ctx,
+		"SELECT id, email, email_verified, totp_enabled, COALESCE(totp_secret, ''), strip_metadata, password_changed_at FROM users WHERE id = $1",
+		id,
+	)
+
+	var user types.User
+	var passwordChangedAt sql.NullTime
+	err := row.Scan(&user.ID, &user.Email, &user.EmailVerified, &user.TOTPEnabled, &user.TOTPSecret, &user.StripMetadata, &passwordChangedAt)
+	user.PasswordChangedAt = passwordChangedAt.Time
+	return user, err
+}
+
+func (p *Postgres) CreateUser(ctx context.Context, email, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, "INSERT INTO users (email, password) VALUES ($1, $2)", email, string(hashedPassword))
+	if isUniqueViolation(err) {
+		return ErrDuplicateEmail
+	}
+	return err
+}
 
+// isUniqueViolation reports whether err is Postgres rejecting a duplicate key
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func (p *Postgres) GetUserByEmail(ctx context.Context, email string) (types.User, error) {
 	var user types.User
-	err := row.Scan(&user.ID, &user.Name)
+	err := p.db.QueryRowContext(ctx,
+		"SELECT id, email, password, email_verified, totp_enabled, COALESCE(totp_secret, ''), strip_metadata FROM users WHERE lower(email) = lower($1)",
+		email,
+	).Scan(&user.ID, &user.Email, &user.Password, &user.EmailVerified, &user.TOTPEnabled, &user.TOTPSecret, &user.StripMetadata)
 	return user, err
 }
 
-func (p *Postgres) CreateUser(email, password string) error {
+func (p *Postgres) UpdatePassword(ctx context.Context, userID int, password string) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	_, err = p.db.Exec("INSERT INTO users (email, password) VALUES ($1, $2)", email, string(hashedPassword))
+	_, err = p.db.ExecContext(ctx, "UPDATE users SET password = $1, password_changed_at = now() WHERE id = $2", string(hashedPassword), userID)
+	return err
+}
+
+func (p *Postgres) MarkEmailVerified(ctx context.Context, userID int) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE users SET email_verified = true WHERE id = $1", userID)
+	return err
+}
+
+func (p *Postgres) SetStripMetadata(ctx context.Context, userID int, strip bool) error {
+	res, err := p.db.ExecContext(ctx, "UPDATE users SET strip_metadata = $1 WHERE id = $2", strip, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (p *Postgres) CreateAccountToken(ctx context.Context, userID int, purpose, tokenHash string, expiresAt time.Time) error {
+	_, err := p.db.ExecContext(ctx,
+		"INSERT INTO account_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, purpose, tokenHash, expiresAt,
+	)
+	return err
+}
+
+// ConsumeAccountToken flags the token as used in the same statement that looks it up,
+// so two concurrent requests can never both redeem it
+func (p *Postgres) ConsumeAccountToken(ctx context.Context, purpose, tokenHash string) (int, error) {
+	var userID int
+	err := p.db.QueryRowContext(ctx,
+		`UPDATE account_tokens SET used_at = now()
+		WHERE purpose = $1 AND token_hash = $2 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id`,
+		purpose, tokenHash,
+	).Scan(&userID)
+	return userID, err
+}
+
+func (p *Postgres) DeleteAccountTokens(ctx context.Context, userID int, purpose string) error {
+	_, err := p.db.ExecContext(ctx,
+		"DELETE FROM account_tokens WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL",
+		userID, purpose,
+	)
 	return err
 }
 
-func (p *Postgres) GetUserByEmail(email string) (types.User, error) {
+func (p *Postgres) GetUserByIdentity(ctx context.Context, provider, subject string) (types.User, error) {
 	var user types.User
-	err := p.db.QueryRow("SELECT id, email, password FROM users WHERE email = $1", email).Scan(&user.ID, &user.Email, &user.Password)
+	err := p.db.QueryRowContext(ctx,
+		`SELECT u.id, u.email, u.password, u.email_verified, u.totp_enabled, COALESCE(u.totp_secret, ''), u.strip_metadata
+		FROM users u JOIN user_identities i ON i.user_id = u.id
+		WHERE i.provider = $1 AND i.subject = $2`,
+		provider, subject,
+	).Scan(&user.ID, &user.Email, &user.Password, &user.EmailVerified, &user.TOTPEnabled, &user.TOTPSecret, &user.StripMetadata)
 	return user, err
 }
+
+func (p *Postgres) LinkIdentity(ctx context.Context, userID int, provider, subject, email string) error {
+	_, err := p.db.ExecContext(ctx,
+		"INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+		userID, provider, subject, email,
+	)
+	return err
+}
+
+func (p *Postgres) SetTOTPSecret(ctx context.Context, userID int, secret string) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE users SET totp_secret = $1, totp_enabled = false WHERE id = $2", secret, userID)
+	return err
+}
+
+func (p *Postgres) EnableTOTP(ctx context.Context, userID int) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE users SET totp_enabled = true WHERE id = $1 AND totp_secret IS NOT NULL", userID)
+	return err
+}
+
+func (p *Postgres) UseTOTPStep(ctx context.Context, userID int, step int64) error {
+	var id int
+	return p.db.QueryRowContext(ctx,
+		"UPDATE users SET totp_last_step = $2 WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2) RETURNING id",
+		userID, step,
+	).Scan(&id)
+}
+
+func (p *Postgres) DisableTOTP(ctx context.Context, userID int) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled = false, totp_secret = NULL WHERE id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Postgres) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (p *Postgres) UseRecoveryCode(ctx context.Context, userID int, codeHash string) error {
+	var id int
+	return p.db.QueryRowContext(ctx,
+		"UPDATE recovery_codes SET used_at = now() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL RETURNING id",
+		userID, codeHash,
+	).Scan(&id)
+}
+
+func (p *Postgres) CreatePhoto(ctx context.Context, userID int, key string, size int64) error {
+	_, err := p.db.ExecContext(ctx, "INSERT INTO photos (key, user_id, size) VALUES ($1, $2, $3)", key, userID, size)
+	return err
+}
+
+func (p *Postgres) TrashPhoto(ctx context.Context, userID int, key string) error {
+	_, err := p.db.ExecContext(ctx,
+		`INSERT INTO photos (key, user_id, deleted_at) VALUES ($1, $2, now())
+		ON CONFLICT (key) DO UPDATE SET deleted_at = now() WHERE photos.user_id = $2`,
+		key, userID,
+	)
+	return err
+}
+
+func (p *Postgres) RestorePhoto(ctx context.Context, userID int, key string) error {
+	var restored string
+	return p.db.QueryRowContext(ctx,
+		"UPDATE photos SET deleted_at = NULL WHERE key = $1 AND user_id = $2 AND deleted_at IS NOT NULL RETURNING key",
+		key, userID,
+	).Scan(&restored)
+}
+
+func scanTrashedPhotos(rows *sql.Rows) ([]types.TrashedPhoto, error) {
+	defer rows.Close()
+
+	var photos []types.TrashedPhoto
+	for rows.Next() {
+		var photo types.TrashedPhoto
+		if err := rows.Scan(&photo.Key, &photo.UserID, &photo.Size, &photo.DeletedAt); err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, rows.Err()
+}
+
+func (p *Postgres) ListTrash(ctx context.Context, userID int) ([]types.TrashedPhoto, error) {
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT key, user_id, size, deleted_at FROM photos WHERE user_id = $1 AND deleted_at IS NOT NULL ORDER BY deleted_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanTrashedPhotos(rows)
+}
+
+func (p *Postgres) ExpiredTrash(ctx context.Context, before time.Time, limit int) ([]types.TrashedPhoto, error) {
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT key, user_id, size, deleted_at FROM photos WHERE deleted_at < $1 ORDER BY deleted_at LIMIT $2",
+		before, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanTrashedPhotos(rows)
+}
+
+func (p *Postgres) DeletePhoto(ctx context.Context, key string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// album_photos has no foreign key to photos, so memberships are removed here
+	if _, err := tx.ExecContext(ctx, "DELETE FROM album_photos WHERE photo_key = $1", key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE albums SET cover_key = NULL WHERE cover_key = $1", key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM photos WHERE key = $1", key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/alvarofc/mode/types"
+)
+
+func (p *Postgres) ListIdentities(ctx context.Context, userID int) ([]types.Identity, error) {
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT provider, subject, email, created_at FROM user_identities WHERE user_id = $1 ORDER BY created_at, provider",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []types.Identity
+	for rows.Next() {
+		var identity types.Identity
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteUser records the deletion and deletes the user in one transaction; every table
+// referencing users cascades, so this removes all of the account's rows
+func (p *Postgres) DeleteUser(ctx context.Context, userID int) (types.AccountDeletion, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return types.AccountDeletion{}, err
+	}
+	defer tx.Rollback()
+
+	// Locking the user keeps two concurrent deletions from both being recorded
+	deletion := types.AccountDeletion{UserID: userID}
+	err = tx.QueryRowContext(ctx,
+		`SELECT
+			(SELECT count(*) FROM photos WHERE user_id = u.id),
+			(SELECT count(*) FROM albums WHERE user_id = u.id),
+			(SELECT count(*) FROM shares WHERE user_id = u.id)
+		FROM users u WHERE u.id = $1 FOR UPDATE`,
+		userID,
+	).Scan(&deletion.Photos, &deletion.Albums, &deletion.Shares)
+	if err != nil {
+		return types.AccountDeletion{}, err
+	}
+
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO account_deletions (user_id, photos, albums, shares) VALUES ($1, $2, $3, $4) RETURNING id, deleted_at",
+		userID, deletion.Photos, deletion.Albums, deletion.Shares,
+	).Scan(&deletion.ID, &deletion.DeletedAt)
+	if err != nil {
+		return types.AccountDeletion{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID); err != nil {
+		return types.AccountDeletion{}, err
+	}
+
+	return deletion, tx.Commit()
+}
+
+func (p *Postgres) PendingAccountPurges(ctx context.Context, limit int) ([]types.AccountDeletion, error) {
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT id, user_id, photos, albums, shares, deleted_at, objects_purged_at FROM account_deletions
+		WHERE objects_purged_at IS NULL ORDER BY deleted_at LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deletions []types.AccountDeletion
+	for rows.Next() {
+		var deletion types.AccountDeletion
+		var purgedAt sql.NullTime
+		err := rows.Scan(&deletion.ID, &deletion.UserID, &deletion.Photos, &deletion.Albums, &deletion.Shares,
+			&deletion.DeletedAt, &purgedAt)
+		if err != nil {
+			return nil, err
+		}
+		if purgedAt.Valid {
+			deletion.ObjectsPurgedAt = &purgedAt.Time
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, rows.Err()
+}
+
+func (p *Postgres) MarkAccountPurged(ctx context.Context, deletionID int) error {
+	_, err := p.db.ExecContext(ctx,
+		"UPDATE account_deletions SET objects_purged_at = now() WHERE id = $1 AND objects_purged_at IS NULL",
+		deletionID,
+	)
+	return err
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/alvarofc/mode/types"
+	"github.com/lib/pq"
+)
+
+// albumColumns selects an album with the number of its photos that aren't in the trash
+const albumColumns = `a.id, a.user_id, a.name, COALESCE(a.cover_key, ''), a.created_at,
+	(SELECT count(*) FROM album_photos ap JOIN photos p ON p.key = ap.photo_key AND p.user_id = a.user_id
+	WHERE ap.album_id = a.id AND p.deleted_at IS NULL)`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAlbum(row rowScanner) (types.Album, error) {
+	var album types.Album
+	err := row.Scan(&album.ID, &album.UserID, &album.Name, &album.CoverKey, &album.CreatedAt, &album.PhotoCount)
+	return album, err
+}
+
+func (p *Postgres) CreateAlbum(ctx context.Context, userID int, name string) (types.Album, error) {
+	album := types.Album{UserID: userID, Name: name}
+	err := p.db.QueryRowContext(ctx,
+		"INSERT INTO albums (user_id, name) VALUES ($1, $2) RETURNING id, created_at",
+		userID, name,
+	).Scan(&album.ID, &album.CreatedAt)
+	return album, err
+}
+
+func (p *Postgres) ListAlbums(ctx context.Context, userID int) ([]types.Album, error) {
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT "+albumColumns+" FROM albums a WHERE a.user_id = $1 ORDER BY a.created_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var albums []types.Album
+	for rows.Next() {
+		album, err := scanAlbum(rows)
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, album)
+	}
+	return albums, rows.Err()
+}
+
+func (p *Postgres) GetAlbum(ctx context.Context, userID, albumID int) (types.Album, error) {
+	return scanAlbum(p.db.QueryRowContext(ctx,
+		"SELECT "+albumColumns+" FROM albums a WHERE a.id = $1 AND a.user_id = $2",
+		albumID, userID,
+	))
+}
+
+func (p *Postgres) RenameAlbum(ctx context.Context, userID, albumID int, name string) error {
+	var id int
+	return p.db.QueryRowContext(ctx,
+		"UPDATE albums SET name = $3 WHERE id = $1 AND user_id = $2 RETURNING id",
+		albumID, userID, name,
+	).Scan(&id)
+}
+
+func (p *Postgres) DeleteAlbum(ctx context.Context, userID, albumID int) error {
+	var id int
+	return p.db.QueryRowContext(ctx,
+		"DELETE FROM albums WHERE id = $1 AND user_id = $2 RETURNING id",
+		albumID, userID,
+	).Scan(&id)
+}
+
+func (p *Postgres) SetAlbumCover(ctx context.Context, userID, albumID int, key string) error {
+	var id int
+	return p.db.QueryRowContext(ctx,
+		`UPDATE albums SET cover_key = NULLIF($3, '')
+		WHERE id = $1 AND user_id = $2
+		AND ($3 = '' OR EXISTS (
+			SELECT 1 FROM album_photos ap JOIN photos p ON p.key = ap.photo_key
+			WHERE ap.album_id = $1 AND ap.photo_key = $3 AND p.user_id = $2 AND p.deleted_at IS NULL
+		))
+		RETURNING id`,
+		albumID, userID, key,
+	).Scan(&id)
+}
+
+// lockAlbum checks ownership and serializes changes to the album's photo list within tx
+func lockAlbum(ctx context.Context, tx *sql.Tx, userID, albumID int) error {
+	var id int
+	return tx.QueryRowContext(ctx,
+		"SELECT id FROM albums WHERE id = $1 AND user_id = $2 FOR UPDATE",
+		albumID, userID,
+	).Scan(&id)
+}
+
+func (p *Postgres) AddAlbumPhotos(ctx context.Context, userID, albumID int, keys []string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockAlbum(ctx, tx, userID, albumID); err != nil {
+		return err
+	}
+
+	// Only the user's own catalogued photos can be added, whatever their keys look like
+	distinct := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		distinct[key] = true
+	}
+	var found int
+	err = tx.QueryRowContext(ctx,
+		"SELECT count(*) FROM photos WHERE user_id = $1 AND key = ANY($2) AND deleted_at IS NULL",
+		userID, pq.Array(keys),
+	).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != len(distinct) {
+		return ErrPhotoNotFound
+	}
+
+	var position int
+	err = tx.QueryRowContext(ctx,
+		"SELECT COALESCE(MAX(position), 0) FROM album_photos WHERE album_id = $1",
+		albumID,
+	).Scan(&position)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		res, err := tx.ExecContext(ctx,
+			"INSERT INTO album_photos (album_id, photo_key, position) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			albumID, key, position+1,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			position++
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (p *Postgres) RemoveAlbumPhoto(ctx context.Context, userID, albumID int, key string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockAlbum(ctx, tx, userID, albumID); err != nil {
+		return err
+	}
+
+	var removed string
+	err = tx.QueryRowContext(ctx,
+		"DELETE FROM album_photos WHERE album_id = $1 AND photo_key = $2 RETURNING photo_key",
+		albumID, key,
+	).Scan(&removed)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE albums SET cover_key = NULL WHERE id = $1 AND cover_key = $2", albumID, key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Postgres) ReorderAlbumPhotos(ctx context.Context, userID, albumID int, keys []string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockAlbum(ctx, tx, userID, albumID); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT photo_key FROM album_photos WHERE album_id = $1", albumID)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		current[key] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if !samePhotoSet(current, keys) {
+		return ErrInvalidOrder
+	}
+	for i, key := range keys {
+		_, err := tx.ExecContext(ctx,
+			"UPDATE album_photos SET position = $3 WHERE album_id = $1 AND photo_key = $2",
+			albumID, key, i+1,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// samePhotoSet reports whether keys lists every key of current exactly once
+func samePhotoSet(current map[string]bool, keys []string) bool {
+	if len(keys) != len(current) {
+		return false
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !current[key] || seen[key] {
+			return false
+		}
+		seen[key] = true
+	}
+	return true
+}
+
+func (p *Postgres) AlbumPhotos(ctx context.Context, userID, albumID int) ([]types.ImageInfo, error) {
+	var id int
+	err := p.db.QueryRowContext(ctx, "SELECT id FROM albums WHERE id = $1 AND user_id = $2", albumID, userID).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT ap.photo_key, p.size, p.created_at
+		FROM album_photos ap JOIN photos p ON p.key = ap.photo_key AND p.user_id = $2
+		WHERE ap.album_id = $1 AND p.deleted_at IS NULL
+		ORDER BY ap.position`,
+		albumID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []types.ImageInfo{}
+	for rows.Next() {
+		var image types.ImageInfo
+		if err := rows.Scan(&image.Key, &image.Size, &image.Modified); err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alvarofc/mode/types"
+	"github.com/lib/pq"
+)
+
+// Hashes are stored in a BIGINT, so they are converted to int64 and back bit for bit
+
+func (p *Postgres) SetPhotoHash(ctx context.Context, key string, hash uint64) error {
+	var updated string
+	return p.db.QueryRowContext(ctx,
+		"UPDATE photos SET phash = $2 WHERE key = $1 RETURNING key",
+		key, int64(hash),
+	).Scan(&updated)
+}
+
+func (p *Postgres) SimilarPhotos(ctx context.Context, userID int, hash uint64, maxDistance, limit int) ([]types.SimilarPhoto, error) {
+	// The distance is the number of ones in the XOR of the hashes; counting them through the
+	// bit string's text works on every Postgres version, unlike bit_count
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT key, size, created_at, distance FROM (
+			SELECT key, size, created_at, length(replace(((phash # $2)::bit(64))::text, '0', '')) AS distance
+			FROM photos WHERE user_id = $1 AND deleted_at IS NULL AND phash IS NOT NULL
+		) p
+		WHERE distance <= $3
+		ORDER BY distance, created_at DESC
+		LIMIT $4`,
+		userID, int64(hash), maxDistance, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var photos []types.SimilarPhoto
+	for rows.Next() {
+		var photo types.SimilarPhoto
+		if err := rows.Scan(&photo.Key, &photo.Size, &photo.Modified, &photo.Distance); err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, rows.Err()
+}
+
+func (p *Postgres) SetPhotoChecksum(ctx context.Context, key, checksum string) error {
+	var updated string
+	return p.db.QueryRowContext(ctx,
+		"UPDATE photos SET sha256 = $2 WHERE key = $1 RETURNING key",
+		key, checksum,
+	).Scan(&updated)
+}
+
+func (p *Postgres) PhotoWithChecksum(ctx context.Context, userID int, checksum string) (string, error) {
+	var key string
+	err := p.db.QueryRowContext(ctx,
+		"SELECT key FROM photos WHERE user_id = $1 AND sha256 = $2 AND deleted_at IS NULL ORDER BY created_at LIMIT 1",
+		userID, checksum,
+	).Scan(&key)
+	return key, err
+}
+
+func (p *Postgres) SetImageMetadata(ctx context.Context, key string, meta types.ImageMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	var updated string
+	return p.db.QueryRowContext(ctx,
+		"UPDATE photos SET image_metadata = $2 WHERE key = $1 RETURNING key",
+		key, data,
+	).Scan(&updated)
+}
+
+func (p *Postgres) ImageMetadata(ctx context.Context, keys []string) (map[string]types.ImageMetadata, error) {
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT key, image_metadata FROM photos WHERE key = ANY($1) AND image_metadata IS NOT NULL",
+		pq.Array(keys),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]types.ImageMetadata, len(keys))
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, err
+		}
+		var meta types.ImageMetadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("invalid image_metadata for %s: %w", key, err)
+		}
+		metadata[key] = meta
+	}
+	return metadata, rows.Err()
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+)
+
+func (p *Postgres) CreateExport(ctx context.Context, userID int, expiresAt time.Time) (types.Export, error) {
+	export := types.Export{UserID: userID, ExpiresAt: expiresAt}
+	err := p.db.QueryRowContext(ctx,
+		"INSERT INTO exports (user_id, expires_at) VALUES ($1, $2) RETURNING id, created_at",
+		userID, expiresAt,
+	).Scan(&export.ID, &export.CreatedAt)
+	return export, err
+}
+
+func (p *Postgres) GetExport(ctx context.Context, userID, exportID int) (types.Export, error) {
+	var export types.Export
+	var completedAt sql.NullTime
+	err := p.db.QueryRowContext(ctx,
+		"SELECT id, user_id, created_at, expires_at, completed_at FROM exports WHERE id = $1 AND user_id = $2",
+		exportID, userID,
+	).Scan(&export.ID, &export.UserID, &export.CreatedAt, &export.ExpiresAt, &completedAt)
+	if completedAt.Valid {
+		export.CompletedAt = &completedAt.Time
+	}
+	return export, err
+}
+
+func (p *Postgres) CompleteExport(ctx context.Context, exportID int) error {
+	_, err := p.db.ExecContext(ctx,
+		"UPDATE exports SET completed_at = now() WHERE id = $1 AND completed_at IS NULL",
+		exportID,
+	)
+	return err
+}
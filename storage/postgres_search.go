@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/alvarofc/mode/types"
+	"github.com/lib/pq"
+)
+
+const photoDetailsColumns = "key, size, created_at, source, prompt, generation_params, tags, phash"
+
+func scanPhotoDetails(row rowScanner, extra ...interface{}) (types.PhotoDetails, error) {
+	var photo types.PhotoDetails
+	var params []byte
+	var hash sql.NullInt64
+	dest := append([]interface{}{
+		&photo.Key, &photo.Size, &photo.Modified, &photo.Source, &photo.Prompt, &params, pq.Array(&photo.Tags), &hash,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return photo, err
+	}
+	if hash.Valid {
+		h := uint64(hash.Int64)
+		photo.Hash = &h
+	}
+	if err := json.Unmarshal(params, &photo.GenerationParams); err != nil {
+		return photo, fmt.Errorf("invalid generation_params for %s: %w", photo.Key, err)
+	}
+	return photo, nil
+}
+
+func (p *Postgres) GetPhoto(ctx context.Context, userID int, key string) (types.PhotoDetails, error) {
+	return scanPhotoDetails(p.db.QueryRowContext(ctx,
+		"SELECT "+photoDetailsColumns+" FROM photos WHERE key = $1 AND user_id = $2 AND deleted_at IS NULL",
+		key, userID,
+	))
+}
+
+func (p *Postgres) UpdatePhotoMetadata(ctx context.Context, userID int, key string, meta types.PhotoMetadata) error {
+	params, err := json.Marshal(meta.GenerationParams)
+	if err != nil {
+		return err
+	}
+	if meta.GenerationParams == nil {
+		params = []byte("{}")
+	}
+	if meta.Tags == nil {
+		meta.Tags = []string{}
+	}
+
+	var updated string
+	return p.db.QueryRowContext(ctx,
+		`UPDATE photos SET source = $3, prompt = $4, generation_params = $5, tags = $6
+		WHERE key = $1 AND user_id = $2 AND deleted_at IS NULL
+		RETURNING key`,
+		key, userID, meta.Source, meta.Prompt, params, pq.Array(meta.Tags),
+	).Scan(&updated)
+}
+
+// SearchPhotos ranks matches with ts_rank; the query is parsed both stemmed (for prompts)
+// and verbatim (for tags), matching how search_vector is built
+func (p *Postgres) SearchPhotos(ctx context.Context, userID int, query PhotoQuery) ([]types.PhotoDetails, error) {
+	args := []interface{}{userID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := []string{"user_id = $1", "deleted_at IS NULL"}
+	rank := "0"
+	if query.Text != "" {
+		q := arg(query.Text)
+		tsquery := fmt.Sprintf("(websearch_to_tsquery('english', %s) || websearch_to_tsquery('simple', %s))", q, q)
+		where = append(where, "search_vector @@ "+tsquery)
+		rank = "ts_rank(search_vector, " + tsquery + ")"
+	}
+	if len(query.Tags) > 0 {
+		where = append(where, "tags @> "+arg(pq.Array(query.Tags))+"::text[]")
+	}
+	if !query.From.IsZero() {
+		where = append(where, "created_at >= "+arg(query.From))
+	}
+	if !query.To.IsZero() {
+		where = append(where, "created_at < "+arg(query.To))
+	}
+	if query.MinSize > 0 {
+		where = append(where, "size >= "+arg(query.MinSize))
+	}
+	if query.MaxSize > 0 {
+		where = append(where, "size <= "+arg(query.MaxSize))
+	}
+	if query.Source != "" {
+		where = append(where, "source = "+arg(query.Source))
+	}
+
+	sqlQuery := fmt.Sprintf("SELECT %s, %s AS rank FROM photos WHERE %s ORDER BY rank DESC, created_at DESC",
+		photoDetailsColumns, rank, strings.Join(where, " AND "))
+	if query.Limit > 0 {
+		sqlQuery += " LIMIT " + arg(query.Limit)
+	}
+	sqlQuery += " OFFSET " + arg(query.Offset)
+
+	rows, err := p.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var photos []types.PhotoDetails
+	for rows.Next() {
+		var rank float64
+		photo, err := scanPhotoDetails(rows, &rank)
+		if err != nil {
+			return nil, err
+		}
+		photo.Rank = rank
+		photos = append(photos, photo)
+	}
+	return photos, rows.Err()
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/alvarofc/mode/types"
+)
+
+const shareColumns = `id, slug, user_id, COALESCE(photo_key, ''), COALESCE(album_id, 0), COALESCE(password_hash, ''),
+	expires_at, COALESCE(max_downloads, 0), downloads, views, created_at`
+
+func scanShare(row rowScanner) (types.Share, error) {
+	var share types.Share
+	var expiresAt sql.NullTime
+	err := row.Scan(&share.ID, &share.Slug, &share.UserID, &share.PhotoKey, &share.AlbumID, &share.PasswordHash,
+		&expiresAt, &share.MaxDownloads, &share.Downloads, &share.Views, &share.CreatedAt)
+	if expiresAt.Valid {
+		share.ExpiresAt = &expiresAt.Time
+	}
+	return share, err
+}
+
+func (p *Postgres) CreateShare(ctx context.Context, share types.Share) (types.Share, error) {
+	err := p.db.QueryRowContext(ctx,
+		`INSERT INTO shares (slug, user_id, photo_key, album_id, password_hash, expires_at, max_downloads)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, 0), NULLIF($5, ''), $6, NULLIF($7, 0))
+		RETURNING id, created_at`,
+		share.Slug, share.UserID, share.PhotoKey, share.AlbumID, share.PasswordHash, share.ExpiresAt, share.MaxDownloads,
+	).Scan(&share.ID, &share.CreatedAt)
+	return share, err
+}
+
+func (p *Postgres) ListShares(ctx context.Context, userID int) ([]types.Share, error) {
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT "+shareColumns+" FROM shares WHERE user_id = $1 ORDER BY created_at DESC, id DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []types.Share
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+func (p *Postgres) GetShare(ctx context.Context, slug string) (types.Share, error) {
+	return scanShare(p.db.QueryRowContext(ctx, "SELECT "+shareColumns+" FROM shares WHERE slug = $1", slug))
+}
+
+func (p *Postgres) DeleteShare(ctx context.Context, userID, shareID int) error {
+	var id int
+	return p.db.QueryRowContext(ctx,
+		"DELETE FROM shares WHERE id = $1 AND user_id = $2 RETURNING id",
+		shareID, userID,
+	).Scan(&id)
+}
+
+func (p *Postgres) RecordShareView(ctx context.Context, shareID int) error {
+	var id int
+	return p.db.QueryRowContext(ctx,
+		"UPDATE shares SET views = views + 1 WHERE id = $1 RETURNING id",
+		shareID,
+	).Scan(&id)
+}
+
+func (p *Postgres) RecordShareDownload(ctx context.Context, shareID int) error {
+	// The limit is checked in the same statement, so concurrent downloads can't overshoot it
+	var id int
+	err := p.db.QueryRowContext(ctx,
+		`UPDATE shares SET downloads = downloads + 1
+		WHERE id = $1 AND (max_downloads IS NULL OR downloads < max_downloads)
+		RETURNING id`,
+		shareID,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := p.db.QueryRowContext(ctx, "SELECT id FROM shares WHERE id = $1", shareID).Scan(&id); err != nil {
+			return err
+		}
+		return ErrShareExhausted
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/storage/storagetest"
+)
+
+// TestPostgres runs the conformance suite against the database in TEST_DATABASE_URL
+// Each test gets its own migrated schema, which is dropped afterwards.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening %s: %v", dsn, err)
+	}
+	defer admin.Close()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		ctx := context.Background()
+
+		schema := fmt.Sprintf("storagetest_%d", time.Now().UnixNano())
+		if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+			t.Fatalf("CREATE SCHEMA: %v", err)
+		}
+		t.Cleanup(func() {
+			if _, err := admin.ExecContext(context.Background(), "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+				t.Errorf("DROP SCHEMA: %v", err)
+			}
+		})
+
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatalf("invalid TEST_DATABASE_URL: %v", err)
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+
+		pg, err := storage.NewPostgres(ctx, storage.PostgresConfig{
+			URL:            u.String(),
+			MaxOpenConns:   4,
+			MaxIdleConns:   2,
+			ConnectTimeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("NewPostgres: %v", err)
+		}
+		t.Cleanup(func() { pg.Close() })
+
+		if _, err := pg.MigrateUp(ctx); err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		return pg
+	})
+}
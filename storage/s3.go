@@ -2,9 +2,14 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image/png"
 	"io"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"sync"
@@ -13,22 +18,32 @@ import (
 	"github.com/alvarofc/mode/types"
 	"github.com/alvarofc/mode/utils"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/nfnt/resize"
-	"github.com/patrickmn/go-cache"
 )
 
 // S3Client represents a client for interacting with Amazon S3 or compatible storage services
 type S3Client struct {
 	Client *s3.S3
-	Cache  *cache.Cache
+	Cache  Cache
+	// CacheTTL is how long photo listings are cached, at most until their URLs enter URLs.SafetyWindow
+	CacheTTL time.Duration
+	URLs     URLConfig
+
+	// listings and resizes coalesce concurrent identical cache misses
+	listings *callGroup
+	resizes  *callGroup
+	// generations keeps listings that overlap an invalidation out of the cache
+	generations *generations
 }
 
 // NewS3Client creates and returns a new S3Client instance
 // It sets up the AWS session and S3 client with the provided credentials and configuration
-func NewS3Client(key, secret, url, region string) S3Client {
+// Photo listings are kept in photoCache for cacheTTL.
+func NewS3Client(key, secret, url, region string, photoCache Cache, cacheTTL time.Duration) S3Client {
 	s3Config := &aws.Config{
 		Credentials:      credentials.NewStaticCredentials(key, secret, ""),
 		Endpoint:         aws.String(url),
@@ -40,20 +55,22 @@ func NewS3Client(key, secret, url, region string) S3Client {
 
 	s3Client := s3.New(sess)
 
-	// Create a cache with a default expiration time of 5 minutes and purge unused items every 10 minutes
-	cacheInstance := cache.New(5*time.Minute, 10*time.Minute)
-
 	return S3Client{
-		Client: s3Client,
-		Cache:  cacheInstance,
+		Client:      s3Client,
+		Cache:       photoCache,
+		CacheTTL:    cacheTTL,
+		URLs:        DefaultURLConfig,
+		listings:    &callGroup{},
+		resizes:     &callGroup{},
+		generations: &generations{},
 	}
 }
 
 // DownloadPhotoByKey retrieves a photo from S3 by its key
 // It returns the photo data as a byte slice
-func (s *S3Client) DownloadPhotoByKey(key string) ([]byte, error) {
+func (s *S3Client) DownloadPhotoByKey(ctx context.Context, key string) ([]byte, error) {
 
-	result, err := s.Client.GetObject((&s3.GetObjectInput{
+	result, err := s.Client.GetObjectWithContext(ctx, (&s3.GetObjectInput{
 
 		Bucket: aws.String(os.Getenv("BUCKET_NAME")),
 		Key:    aws.String(key),
@@ -74,17 +91,100 @@ func (s *S3Client) DownloadPhotoByKey(key string) ([]byte, error) {
 
 }
 
-//func (s *S3) UploadPhoto(id int) (types.Photo, error) {}
+// OpenPhoto streams a photo from S3 without reading it into memory
+func (s *S3Client) OpenPhoto(ctx context.Context, key string) (io.ReadCloser, error) {
+	result, err := s.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(os.Getenv("BUCKET_NAME")),
+		Key:    aws.String(key),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrPhotoNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+// WalkPhotos calls fn for each image under user_<id>/ as the ListObjectsV2 pages arrive,
+// so the listing is never held in memory as a whole
+func (s *S3Client) WalkPhotos(ctx context.Context, userID string, fn func(types.ImageInfo) error) error {
+	var fnErr error
+	err := s.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(os.Getenv("BUCKET_NAME")),
+		Prefix: aws.String(fmt.Sprintf("user_%s/", userID)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			if !utils.IsImage(*item.Key) {
+				continue
+			}
+			fnErr = fn(types.ImageInfo{Key: *item.Key, Size: *item.Size, Modified: *item.LastModified})
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("error listing objects: %w", err)
+	}
+	return nil
+}
+
+// UploadPhoto stores a photo under user_<id>/<name> and invalidates the user's cached listings
+func (s *S3Client) UploadPhoto(ctx context.Context, userID, name string, data []byte) (types.ImageInfo, error) {
+	key := fmt.Sprintf("user_%s/%s", userID, name)
+	_, err := s.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(os.Getenv("BUCKET_NAME")),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(http.DetectContentType(data)),
+	})
+	if err != nil {
+		return types.ImageInfo{}, fmt.Errorf("error uploading photo: %w", err)
+	}
+
+	if err := s.invalidatePhotos(ctx, userID); err != nil {
+		return types.ImageInfo{}, fmt.Errorf("error invalidating cached photos: %w", err)
+	}
+
+	return types.ImageInfo{Key: key, Size: int64(len(data)), Modified: time.Now()}, nil
+}
 
 // DownloadSmallPhotoByKey retrieves a photo from S3 by its key and resizes it
 // It returns the resized photo data as a byte slice
 // The photo is resized to 800x600 pixels using the Lanczos3 resampling filter
-func (s *S3Client) DownloadSmallPhotoByKey(key string) ([]byte, error) {
-	pngData, err := s.DownloadPhotoByKey(key)
+// Concurrent requests for the same photo share a single download and resize
+func (s *S3Client) DownloadSmallPhotoByKey(ctx context.Context, key string) ([]byte, error) {
+	photo, err := s.resizes.Do(ctx, fmt.Sprintf("%s@800x600", key), func(ctx context.Context) (interface{}, error) {
+		pngData, err := s.DownloadPhotoByKey(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("error getting original PNG: %w", err)
+		}
+
+		return resizePhoto(pngData)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error getting original PNG: %w", err)
+		return nil, err
 	}
+	// Callers get their own copy of the shared result
+	return bytes.Clone(photo.([]byte)), nil
+}
+
+// CoalescingStats reports how many listing and resize calls were served by an identical call in flight
+func (s *S3Client) CoalescingStats() map[string]CallStats {
+	return map[string]CallStats{
+		"listings": s.listings.Stats(),
+		"resizes":  s.resizes.Stats(),
+	}
+}
 
+// resizePhoto scales a PNG down to the 800x600 preview served for "image/small"
+func resizePhoto(pngData []byte) ([]byte, error) {
 	img, err := png.Decode(bytes.NewReader(pngData))
 	if err != nil {
 		return nil, fmt.Errorf("error decoding PNG: %w", err)
@@ -101,7 +201,7 @@ func (s *S3Client) DownloadSmallPhotoByKey(key string) ([]byte, error) {
 }
 
 // Helper function to process S3 objects
-func (s *S3Client) processS3Objects(userID string, limit int64) ([]types.ImageInfo, error) {
+func (s *S3Client) processS3Objects(ctx context.Context, userID string, limit int64) ([]types.ImageInfo, error) {
 	bucket := os.Getenv("BUCKET_NAME")
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
@@ -113,7 +213,7 @@ func (s *S3Client) processS3Objects(userID string, limit int64) ([]types.ImageIn
 	var wg sync.WaitGroup
 	errChan := make(chan error, 1)
 
-	err := s.Client.ListObjectsV2Pages(input,
+	err := s.Client.ListObjectsV2PagesWithContext(ctx, input,
 		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 			for _, item := range page.Contents {
 				if !utils.IsImage(*item.Key) {
@@ -160,15 +260,83 @@ func (s *S3Client) processS3Objects(userID string, limit int64) ([]types.ImageIn
 	return images, nil
 }
 
+// PresignURL returns a URL for key that stays valid for ttl, rewritten to the public host if one is configured
+func (s *S3Client) PresignURL(ctx context.Context, key string, ttl time.Duration) (string, time.Time, error) {
+	req, _ := s.Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(os.Getenv("BUCKET_NAME")),
+		Key:    aws.String(key),
+	})
+	req.SetContext(ctx)
+
+	if ttl == 0 {
+		ttl = s.URLs.TTL
+	}
+	expires := time.Now().Add(ttl)
+	urlStr, err := req.Presign(ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	urlStr, err = s.URLs.rewrite(urlStr)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return urlStr, expires, nil
+}
+
+// cacheImages stores a listing until shortly before the first of its URLs expires
+// A listing that started in an earlier generation than the user's current one may have missed the
+// change that was invalidated, so it isn't cached. Checking again after the write catches an
+// invalidation that ran in between.
+func (s *S3Client) cacheImages(ctx context.Context, userID string, generation uint64, cacheKey string, value interface{}, images ...types.ImageInfo) {
+	ttl := s.URLs.cacheTTL(s.CacheTTL, images...)
+	if ttl <= 0 || s.generations.current(userID) != generation {
+		return
+	}
+	if err := s.Cache.Set(ctx, cacheKey, value, ttl); err != nil {
+		log.Printf("Error writing cache key %s: %v", cacheKey, err)
+		return
+	}
+	if s.generations.current(userID) != generation {
+		if err := s.Cache.Delete(ctx, cacheKey); err != nil {
+			log.Printf("Error deleting stale cache key %s: %v", cacheKey, err)
+		}
+	}
+}
+
+// invalidatePhotos starts a new generation of the user's listings and drops the cached ones
+func (s *S3Client) invalidatePhotos(ctx context.Context, userID string) error {
+	s.generations.bump(userID)
+	return InvalidateUserPhotos(ctx, s.Cache, userID)
+}
+
 // GetLastXPhotosForUser retrieves the last X photos for a specific user
-func (s *S3Client) GetLastXPhotosForUser(userID string, photoNum int64) ([]types.ImageInfo, error) {
-	cacheKey := fmt.Sprintf("last_%d_photos_%s", photoNum, userID)
+func (s *S3Client) GetLastXPhotosForUser(ctx context.Context, userID string, photoNum int64) ([]types.ImageInfo, error) {
+	cacheKey := lastPhotosKey(userID, photoNum)
+
+	var cachedImages []types.ImageInfo
+	if found, err := s.Cache.Get(ctx, cacheKey, &cachedImages); err != nil {
+		log.Printf("Error reading cache key %s: %v", cacheKey, err)
+	} else if found && s.URLs.fresh(cachedImages...) {
+		return cachedImages, nil
+	}
 
-	if cachedImages, found := s.Cache.Get(cacheKey); found {
-		return cachedImages.([]types.ImageInfo), nil
+	// Concurrent misses for the same key share one listing, unless it started before an invalidation
+	generation := s.generations.current(userID)
+	images, err := s.listings.Do(ctx, fmt.Sprintf("%s@%d", cacheKey, generation), func(ctx context.Context) (interface{}, error) {
+		return s.listLastPhotos(ctx, userID, photoNum, cacheKey, generation)
+	})
+	if err != nil {
+		return nil, err
 	}
+	// Callers get their own copy of the shared result
+	return append([]types.ImageInfo(nil), images.([]types.ImageInfo)...), nil
+}
 
-	images, err := s.processS3Objects(userID, photoNum)
+// listLastPhotos lists and presigns the last photos of a user and caches the result under cacheKey
+// The result is only cached if the user's listings are still at generation.
+func (s *S3Client) listLastPhotos(ctx context.Context, userID string, photoNum int64, cacheKey string, generation uint64) ([]types.ImageInfo, error) {
+	images, err := s.processS3Objects(ctx, userID, photoNum)
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +344,6 @@ func (s *S3Client) GetLastXPhotosForUser(userID string, photoNum int64) ([]types
 	if len(images) == 0 {
 		return nil, fmt.Errorf("no image files found for user %s", userID)
 	}
-	bucket := os.Getenv("BUCKET_NAME")
 
 	// Generate presigned URLs
 	var wg sync.WaitGroup
@@ -186,16 +353,13 @@ func (s *S3Client) GetLastXPhotosForUser(userID string, photoNum int64) ([]types
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			req, _ := s.Client.GetObjectRequest(&s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(images[i].Key),
-			})
-			urlStr, err := req.Presign(1 * time.Hour)
+			urlStr, expires, err := s.PresignURL(ctx, images[i].Key, s.URLs.TTL)
 			if err != nil {
 				errChan <- fmt.Errorf("error generating presigned URL for image %d: %w", i, err)
 				return
 			}
 			images[i].URL = urlStr
+			images[i].URLExpires = expires
 		}(i)
 	}
 
@@ -207,20 +371,37 @@ func (s *S3Client) GetLastXPhotosForUser(userID string, photoNum int64) ([]types
 	}
 
 	// Cache the result
-	s.Cache.Set(cacheKey, images, cache.DefaultExpiration)
+	s.cacheImages(ctx, userID, generation, cacheKey, images, images...)
 
 	return images, nil
 }
 
 // GetLastPhotoForUser retrieves the most recent photo for a specific user
-func (s *S3Client) GetLastPhotoForUser(userID string) (types.ImageInfo, error) {
-	cacheKey := fmt.Sprintf("last_photo_%s", userID)
+func (s *S3Client) GetLastPhotoForUser(ctx context.Context, userID string) (types.ImageInfo, error) {
+	cacheKey := lastPhotoKey(userID)
+
+	var cachedImage types.ImageInfo
+	if found, err := s.Cache.Get(ctx, cacheKey, &cachedImage); err != nil {
+		log.Printf("Error reading cache key %s: %v", cacheKey, err)
+	} else if found && s.URLs.fresh(cachedImage) {
+		return cachedImage, nil
+	}
 
-	if cachedImage, found := s.Cache.Get(cacheKey); found {
-		return cachedImage.(types.ImageInfo), nil
+	// Concurrent misses for the same key share one listing, unless it started before an invalidation
+	generation := s.generations.current(userID)
+	image, err := s.listings.Do(ctx, fmt.Sprintf("%s@%d", cacheKey, generation), func(ctx context.Context) (interface{}, error) {
+		return s.listLastPhoto(ctx, userID, cacheKey, generation)
+	})
+	if err != nil {
+		return types.ImageInfo{}, err
 	}
+	return image.(types.ImageInfo), nil
+}
 
-	images, err := s.processS3Objects(userID, 1)
+// listLastPhoto finds and presigns the most recent photo of a user and caches it under cacheKey
+// The result is only cached if the user's listings are still at generation.
+func (s *S3Client) listLastPhoto(ctx context.Context, userID, cacheKey string, generation uint64) (types.ImageInfo, error) {
+	images, err := s.processS3Objects(ctx, userID, 1)
 	if err != nil {
 		return types.ImageInfo{}, err
 	}
@@ -232,18 +413,128 @@ func (s *S3Client) GetLastPhotoForUser(userID string) (types.ImageInfo, error) {
 	lastImage := images[0]
 
 	// Generate presigned URL
-	req, _ := s.Client.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(os.Getenv("BUCKET_NAME")),
-		Key:    aws.String(lastImage.Key),
-	})
-	urlStr, err := req.Presign(1 * time.Hour)
+	urlStr, expires, err := s.PresignURL(ctx, lastImage.Key, s.URLs.TTL)
 	if err != nil {
 		return types.ImageInfo{}, fmt.Errorf("error generating presigned URL: %w", err)
 	}
 	lastImage.URL = urlStr
+	lastImage.URLExpires = expires
 
 	// Cache the result
-	s.Cache.Set(cacheKey, lastImage, cache.DefaultExpiration)
+	s.cacheImages(ctx, userID, generation, cacheKey, lastImage, lastImage)
 
 	return lastImage, nil
 }
+
+// movePhoto copies an object to a new key and deletes the original
+// S3 has no rename, so a failure between the two steps leaves a copy behind rather than losing the photo.
+func (s *S3Client) movePhoto(ctx context.Context, from, to string) error {
+	bucket := os.Getenv("BUCKET_NAME")
+	source := (&url.URL{Path: bucket + "/" + from}).EscapedPath()
+
+	_, err := s.Client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		CopySource: aws.String(source),
+		Key:        aws.String(to),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return ErrPhotoNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", from, err)
+	}
+
+	_, err = s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(from),
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %w", from, err)
+	}
+	return nil
+}
+
+// TrashPhoto moves a photo to the trash prefix and invalidates the owner's cached listings
+func (s *S3Client) TrashPhoto(ctx context.Context, userID, key string) error {
+	if err := s.movePhoto(ctx, key, TrashPrefix+key); err != nil {
+		return err
+	}
+	return s.invalidatePhotos(ctx, userID)
+}
+
+// RestorePhoto moves a trashed photo back to its original key
+func (s *S3Client) RestorePhoto(ctx context.Context, userID, key string) error {
+	if err := s.movePhoto(ctx, TrashPrefix+key, key); err != nil {
+		return err
+	}
+	return s.invalidatePhotos(ctx, userID)
+}
+
+// PurgePhoto deletes a trashed photo and everything under its derivatives prefix
+func (s *S3Client) PurgePhoto(ctx context.Context, key string) error {
+	bucket := os.Getenv("BUCKET_NAME")
+	keys := []*s3.ObjectIdentifier{{Key: aws.String(TrashPrefix + key)}}
+
+	err := s.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(DerivativesPrefix + key + "/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			keys = append(keys, &s3.ObjectIdentifier{Key: item.Key})
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("error listing derivatives: %w", err)
+	}
+	return s.deleteObjects(ctx, bucket, keys)
+}
+
+// PurgeUser deletes every object of a user: their photos, their trash and the derivatives of both
+// Each page of the listing is deleted as it arrives, so accounts of any size can be purged.
+func (s *S3Client) PurgeUser(ctx context.Context, userID string) error {
+	bucket := os.Getenv("BUCKET_NAME")
+	user := fmt.Sprintf("user_%s/", userID)
+
+	for _, prefix := range []string{user, TrashPrefix + user, DerivativesPrefix + user} {
+		var deleteErr error
+		err := s.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			keys := make([]*s3.ObjectIdentifier, len(page.Contents))
+			for i, item := range page.Contents {
+				keys[i] = &s3.ObjectIdentifier{Key: item.Key}
+			}
+			deleteErr = s.deleteObjects(ctx, bucket, keys)
+			return deleteErr == nil
+		})
+		if deleteErr != nil {
+			return deleteErr
+		}
+		if err != nil {
+			return fmt.Errorf("error listing %s: %w", prefix, err)
+		}
+	}
+	return s.invalidatePhotos(ctx, userID)
+}
+
+// deleteObjects deletes keys from the bucket, failing on the first key that can't be deleted
+func (s *S3Client) deleteObjects(ctx context.Context, bucket string, keys []*s3.ObjectIdentifier) error {
+	// DeleteObjects accepts at most 1000 keys per request
+	for start := 0; start < len(keys); start += 1000 {
+		end := min(start+1000, len(keys))
+		out, err := s.Client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: keys[start:end], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting objects: %w", err)
+		}
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("error deleting %s: %s", aws.StringValue(out.Errors[0].Key), aws.StringValue(out.Errors[0].Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/alvarofc/mode/storage/s3test"
+)
+
+// TestMinIO runs the conformance suite against the S3-compatible endpoint in S3TEST_URL
+func TestMinIO(t *testing.T) {
+	s3test.Run(t, s3test.MinIO)
+}
@@ -0,0 +1,440 @@
+// Package s3test is a conformance suite for storage.S3 implementations
+//
+// LocalFS and S3Client both have to pass it, so that development against a
+// directory behaves like production against a bucket:
+//
+//	func TestLocalFS(t *testing.T) { s3test.Run(t, s3test.LocalFS) }
+//	func TestMinIO(t *testing.T)   { s3test.Run(t, s3test.MinIO) }
+//
+// MinIO is skipped unless S3TEST_URL points at an S3-compatible endpoint, e.g.
+// a local `minio server` with S3TEST_KEY_ID and S3TEST_APP_KEY set to its credentials.
+package s3test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Seeder stores an object before the suite reads it back
+// Objects are seeded oldest first; implementations that can't set the modification
+// time must make sure later objects get a later LastModified.
+type Seeder func(t *testing.T, key string, data []byte, modified time.Time)
+
+// Factory returns an empty store and a way to put objects into it
+type Factory func(t *testing.T) (storage.S3, Seeder)
+
+// LocalFS is a Factory for a LocalFS rooted in a temporary directory
+func LocalFS(t *testing.T) (storage.S3, Seeder) {
+	fs, err := storage.NewLocalFS(t.TempDir(), "/files", []byte("s3test"))
+	if err != nil {
+		t.Fatalf("NewLocalFS: %v", err)
+	}
+
+	return fs, func(t *testing.T, key string, data []byte, modified time.Time) {
+		t.Helper()
+		if err := fs.WritePhoto(key, data, modified); err != nil {
+			t.Fatalf("WritePhoto %s: %v", key, err)
+		}
+	}
+}
+
+// MinIO is a Factory for an S3Client using a fresh bucket on the endpoint in S3TEST_URL
+func MinIO(t *testing.T) (storage.S3, Seeder) {
+	endpoint := os.Getenv("S3TEST_URL")
+	if endpoint == "" {
+		t.Skip("S3TEST_URL is not set")
+	}
+	region := os.Getenv("S3TEST_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	client := storage.NewS3Client(os.Getenv("S3TEST_KEY_ID"), os.Getenv("S3TEST_APP_KEY"), endpoint, region, storage.NewMemoryCache(), 5*time.Minute)
+	bucket := fmt.Sprintf("s3test-%d", time.Now().UnixNano())
+	if _, err := client.Client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	// S3Client reads the bucket from the environment on every call
+	t.Setenv("BUCKET_NAME", bucket)
+
+	var last time.Time
+	return &client, func(t *testing.T, key string, data []byte, modified time.Time) {
+		t.Helper()
+		// LastModified has a resolution of one second and can't be set by the client
+		if wait := time.Until(last.Add(time.Second)); wait > 0 {
+			time.Sleep(wait)
+		}
+		_, err := client.Client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(data),
+		})
+		if err != nil {
+			t.Fatalf("PutObject %s: %v", key, err)
+		}
+		last = time.Now()
+	}
+}
+
+// testPNG encodes a solid image of the given size
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encoding PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Run runs the conformance suite against the stores returned by newS3
+func Run(t *testing.T, newS3 Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.S3, seed Seeder)
+	}{
+		{"DownloadPhotoByKey", testDownload},
+		{"DownloadSmallPhotoByKey", testDownloadSmall},
+		{"MissingKey", testMissingKey},
+		{"LastPhotos", testLastPhotos},
+		{"NoPhotos", testNoPhotos},
+		{"UploadPhoto", testUpload},
+		{"PresignURL", testPresign},
+		{"Trash", testTrash},
+		{"WalkPhotos", testWalkPhotos},
+		{"OpenPhoto", testOpenPhoto},
+		{"PurgeUser", testPurgeUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, seed := newS3(t)
+			tt.fn(t, s, seed)
+		})
+	}
+}
+
+func testDownload(t *testing.T, s storage.S3, seed Seeder) {
+	data := testPNG(t, 4, 4)
+	seed(t, "user_1/a.png", data, time.Now())
+
+	got, err := s.DownloadPhotoByKey(context.Background(), "user_1/a.png")
+	if err != nil {
+		t.Fatalf("DownloadPhotoByKey: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs from the stored object")
+	}
+}
+
+func testDownloadSmall(t *testing.T, s storage.S3, seed Seeder) {
+	seed(t, "user_1/big.png", testPNG(t, 1600, 1200), time.Now())
+
+	got, err := s.DownloadSmallPhotoByKey(context.Background(), "user_1/big.png")
+	if err != nil {
+		t.Fatalf("DownloadSmallPhotoByKey: %v", err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("small photo is not a PNG: %v", err)
+	}
+	if cfg.Width != 800 || cfg.Height != 600 {
+		t.Errorf("small photo is %dx%d, want 800x600", cfg.Width, cfg.Height)
+	}
+}
+
+func testMissingKey(t *testing.T, s storage.S3, seed Seeder) {
+	ctx := context.Background()
+	seed(t, "user_1/a.png", testPNG(t, 4, 4), time.Now())
+
+	for _, key := range []string{"user_1/missing.png", "../user_1/a.png", "user_1/../../a.png"} {
+		if _, err := s.DownloadPhotoByKey(ctx, key); err == nil {
+			t.Errorf("DownloadPhotoByKey(%q) succeeded, want an error", key)
+		}
+	}
+}
+
+func testLastPhotos(t *testing.T, s storage.S3, seed Seeder) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	img := testPNG(t, 4, 4)
+
+	seed(t, "user_1/old.png", img, start)
+	seed(t, "user_1/notes.txt", []byte("not an image"), start.Add(time.Minute))
+	seed(t, "user_12/other.png", img, start.Add(2*time.Minute))
+	seed(t, "user_1/album/middle.jpg", img, start.Add(3*time.Minute))
+	seed(t, "user_1/new.png", img, start.Add(4*time.Minute))
+
+	photos, err := s.GetLastXPhotosForUser(ctx, "1", 2)
+	if err != nil {
+		t.Fatalf("GetLastXPhotosForUser: %v", err)
+	}
+	var keys []string
+	for _, p := range photos {
+		keys = append(keys, p.Key)
+		if p.URL == "" {
+			t.Errorf("%s has no URL", p.Key)
+		}
+		if !p.URLExpires.After(time.Now()) {
+			t.Errorf("%s has a URL that expired at %s", p.Key, p.URLExpires)
+		}
+		if p.Size != int64(len(img)) {
+			t.Errorf("%s has size %d, want %d", p.Key, p.Size, len(img))
+		}
+	}
+	if got, want := strings.Join(keys, ","), "user_1/new.png,user_1/album/middle.jpg"; got != want {
+		t.Errorf("GetLastXPhotosForUser = %s, want %s", got, want)
+	}
+
+	all, err := s.GetLastXPhotosForUser(ctx, "1", 10)
+	if err != nil {
+		t.Fatalf("GetLastXPhotosForUser: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("GetLastXPhotosForUser returned %d photos, want the 3 images of user 1", len(all))
+	}
+
+	last, err := s.GetLastPhotoForUser(ctx, "1")
+	if err != nil {
+		t.Fatalf("GetLastPhotoForUser: %v", err)
+	}
+	if last.Key != "user_1/new.png" || last.URL == "" {
+		t.Errorf("GetLastPhotoForUser = %+v, want user_1/new.png with a URL", last)
+	}
+}
+
+func testNoPhotos(t *testing.T, s storage.S3, seed Seeder) {
+	ctx := context.Background()
+	seed(t, "user_1/notes.txt", []byte("not an image"), time.Now())
+
+	if _, err := s.GetLastXPhotosForUser(ctx, "1", 5); err == nil {
+		t.Error("GetLastXPhotosForUser succeeded for a user without photos")
+	}
+	if _, err := s.GetLastPhotoForUser(ctx, "2"); err == nil {
+		t.Error("GetLastPhotoForUser succeeded for an unknown user")
+	}
+}
+
+func testUpload(t *testing.T, s storage.S3, seed Seeder) {
+	ctx := context.Background()
+	img := testPNG(t, 4, 4)
+	seed(t, "user_1/old.png", img, time.Now().Add(-time.Minute))
+
+	// Warm up any cache, which the upload has to invalidate
+	if _, err := s.GetLastXPhotosForUser(ctx, "1", 10); err != nil {
+		t.Fatalf("GetLastXPhotosForUser: %v", err)
+	}
+	if _, err := s.GetLastPhotoForUser(ctx, "1"); err != nil {
+		t.Fatalf("GetLastPhotoForUser: %v", err)
+	}
+
+	info, err := s.UploadPhoto(ctx, "1", "new.png", img)
+	if err != nil {
+		t.Fatalf("UploadPhoto: %v", err)
+	}
+	if info.Key != "user_1/new.png" || info.Size != int64(len(img)) {
+		t.Errorf("UploadPhoto = %+v, want key user_1/new.png and size %d", info, len(img))
+	}
+
+	got, err := s.DownloadPhotoByKey(ctx, info.Key)
+	if err != nil || !bytes.Equal(got, img) {
+		t.Errorf("DownloadPhotoByKey after upload = %v, want the uploaded data", err)
+	}
+
+	photos, err := s.GetLastXPhotosForUser(ctx, "1", 10)
+	if err != nil {
+		t.Fatalf("GetLastXPhotosForUser: %v", err)
+	}
+	if len(photos) != 2 {
+		t.Errorf("GetLastXPhotosForUser returned %d photos after the upload, want 2", len(photos))
+	}
+}
+
+func testPresign(t *testing.T, s storage.S3, seed Seeder) {
+	seed(t, "user_1/a.png", testPNG(t, 4, 4), time.Now())
+
+	before := time.Now()
+	u, expires, err := s.PresignURL(context.Background(), "user_1/a.png", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("PresignURL: %v", err)
+	}
+	if u == "" {
+		t.Error("PresignURL returned an empty URL")
+	}
+	if expires.Before(before.Add(9*time.Minute)) || expires.After(before.Add(11*time.Minute)) {
+		t.Errorf("URL expires at %s, want about 10 minutes from now", expires)
+	}
+}
+
+func testTrash(t *testing.T, s storage.S3, seed Seeder) {
+	ctx := context.Background()
+	img := testPNG(t, 4, 4)
+	seed(t, "user_1/a.png", img, time.Now().Add(-2*time.Minute))
+	seed(t, "user_1/b.png", img, time.Now().Add(-time.Minute))
+	seed(t, storage.DerivativesPrefix+"user_1/a.png/small.png", img, time.Now())
+
+	if err := s.TrashPhoto(ctx, "1", "user_1/missing.png"); !errors.Is(err, storage.ErrPhotoNotFound) {
+		t.Errorf("TrashPhoto of a missing photo = %v, want ErrPhotoNotFound", err)
+	}
+
+	if _, err := s.GetLastXPhotosForUser(ctx, "1", 10); err != nil {
+		t.Fatalf("GetLastXPhotosForUser: %v", err)
+	}
+	if err := s.TrashPhoto(ctx, "1", "user_1/a.png"); err != nil {
+		t.Fatalf("TrashPhoto: %v", err)
+	}
+	if _, err := s.DownloadPhotoByKey(ctx, "user_1/a.png"); err == nil {
+		t.Error("trashed photo can still be downloaded")
+	}
+	if photos, _ := s.GetLastXPhotosForUser(ctx, "1", 10); len(photos) != 1 {
+		t.Errorf("GetLastXPhotosForUser lists %d photos after trashing one of two", len(photos))
+	}
+
+	if err := s.RestorePhoto(ctx, "1", "user_1/a.png"); err != nil {
+		t.Fatalf("RestorePhoto: %v", err)
+	}
+	if got, err := s.DownloadPhotoByKey(ctx, "user_1/a.png"); err != nil || !bytes.Equal(got, img) {
+		t.Errorf("DownloadPhotoByKey after restoring = %v, want the original data", err)
+	}
+
+	if err := s.TrashPhoto(ctx, "1", "user_1/a.png"); err != nil {
+		t.Fatalf("TrashPhoto: %v", err)
+	}
+	if err := s.PurgePhoto(ctx, "user_1/a.png"); err != nil {
+		t.Fatalf("PurgePhoto: %v", err)
+	}
+	for _, key := range []string{storage.TrashPrefix + "user_1/a.png", storage.DerivativesPrefix + "user_1/a.png/small.png"} {
+		if _, err := s.DownloadPhotoByKey(ctx, key); err == nil {
+			t.Errorf("%s still exists after purging", key)
+		}
+	}
+	if err := s.RestorePhoto(ctx, "1", "user_1/a.png"); !errors.Is(err, storage.ErrPhotoNotFound) {
+		t.Errorf("RestorePhoto after purging = %v, want ErrPhotoNotFound", err)
+	}
+	if _, err := s.DownloadPhotoByKey(ctx, "user_1/b.png"); err != nil {
+		t.Errorf("purging a photo deleted another one: %v", err)
+	}
+}
+
+func testWalkPhotos(t *testing.T, s storage.S3, seed Seeder) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	img := testPNG(t, 4, 4)
+
+	seed(t, "user_1/a.png", img, start)
+	seed(t, "user_1/notes.txt", []byte("not an image"), start.Add(time.Minute))
+	seed(t, "user_12/other.png", img, start.Add(2*time.Minute))
+	seed(t, "user_1/album/b.jpg", img, start.Add(3*time.Minute))
+	seed(t, storage.TrashPrefix+"user_1/trashed.png", img, start.Add(4*time.Minute))
+
+	seen := make(map[string]int64)
+	err := s.WalkPhotos(ctx, "1", func(image types.ImageInfo) error {
+		seen[image.Key] = image.Size
+		if image.Modified.IsZero() {
+			t.Errorf("%s has no modification time", image.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkPhotos: %v", err)
+	}
+	if len(seen) != 2 || seen["user_1/a.png"] != int64(len(img)) || seen["user_1/album/b.jpg"] != int64(len(img)) {
+		t.Errorf("WalkPhotos visited %v, want the 2 images of user 1 with their sizes", seen)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = s.WalkPhotos(ctx, "1", func(types.ImageInfo) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("WalkPhotos after fn failed = %v with %d calls, want the error of fn after 1 call", err, calls)
+	}
+
+	if err := s.WalkPhotos(ctx, "2", func(types.ImageInfo) error { return stop }); err != nil {
+		t.Errorf("WalkPhotos for a user without photos = %v, want no error", err)
+	}
+}
+
+func testOpenPhoto(t *testing.T, s storage.S3, seed Seeder) {
+	ctx := context.Background()
+	data := testPNG(t, 4, 4)
+	seed(t, "user_1/a.png", data, time.Now())
+
+	r, err := s.OpenPhoto(ctx, "user_1/a.png")
+	if err != nil {
+		t.Fatalf("OpenPhoto: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("reading the opened photo = %v, want the stored data", err)
+	}
+
+	if _, err := s.OpenPhoto(ctx, "user_1/missing.png"); !errors.Is(err, storage.ErrPhotoNotFound) {
+		t.Errorf("OpenPhoto of a missing photo = %v, want ErrPhotoNotFound", err)
+	}
+}
+
+func testPurgeUser(t *testing.T, s storage.S3, seed Seeder) {
+	ctx := context.Background()
+	img := testPNG(t, 4, 4)
+	gone := []string{
+		"user_1/a.png",
+		"user_1/album/b.png",
+		storage.TrashPrefix + "user_1/c.png",
+		storage.DerivativesPrefix + "user_1/a.png/small.png",
+	}
+	kept := []string{"user_12/a.png", storage.TrashPrefix + "user_12/c.png", storage.DerivativesPrefix + "user_12/a.png/small.png"}
+	for i, key := range append(append([]string{}, gone...), kept...) {
+		seed(t, key, img, time.Now().Add(time.Duration(i-10)*time.Minute))
+	}
+
+	// Warm up any cache, which the purge has to invalidate
+	if _, err := s.GetLastXPhotosForUser(ctx, "1", 10); err != nil {
+		t.Fatalf("GetLastXPhotosForUser: %v", err)
+	}
+
+	if err := s.PurgeUser(ctx, "1"); err != nil {
+		t.Fatalf("PurgeUser: %v", err)
+	}
+	for _, key := range gone {
+		if _, err := s.DownloadPhotoByKey(ctx, key); err == nil {
+			t.Errorf("%s still exists after purging its user", key)
+		}
+	}
+	for _, key := range kept {
+		if _, err := s.DownloadPhotoByKey(ctx, key); err != nil {
+			t.Errorf("purging user 1 deleted %s: %v", key, err)
+		}
+	}
+	if photos, err := s.GetLastXPhotosForUser(ctx, "1", 10); err == nil {
+		t.Errorf("GetLastXPhotosForUser after purging = %d photos, want an error", len(photos))
+	}
+
+	if err := s.PurgeUser(ctx, "1"); err != nil {
+		t.Errorf("purging a user twice: %v", err)
+	}
+}
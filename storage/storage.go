@@ -1,17 +1,189 @@
 package storage
 
-import "github.com/alvarofc/mode/types"
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+)
+
+// ErrDuplicateEmail is returned by CreateUser when the email is already registered
+var ErrDuplicateEmail = errors.New("email already registered")
+
+// ErrPhotoNotFound is returned by the file stores when a photo doesn't exist, and by AddAlbumPhotos
+// when a key isn't one of the user's catalogued photos
+var ErrPhotoNotFound = errors.New("photo not found")
+
+// PhotoQuery filters a photo search; zero fields don't filter
+type PhotoQuery struct {
+	// Text is matched against tags and prompts using web search syntax ("quoted phrases", -exclusions, or)
+	Text string
+	// Tags must all be present on a photo
+	Tags []string
+	// From and To bound the upload time, To being exclusive
+	From, To         time.Time
+	MinSize, MaxSize int64
+	Source           string
+	Limit, Offset    int
+}
+
+// ErrShareExhausted is returned by RecordShareDownload when a share has no downloads left
+var ErrShareExhausted = errors.New("share has reached its download limit")
+
+// ErrInvalidOrder is returned by ReorderAlbumPhotos when the keys don't match the album
+var ErrInvalidOrder = errors.New("keys must list every photo in the album exactly once")
+
+// Objects other than originals live under dedicated prefixes, outside the user_<id>/ listings
+const (
+	// TrashPrefix holds soft-deleted photos under their original key
+	TrashPrefix = "trash/"
+	// DerivativesPrefix holds variants generated from a photo, under derivatives/<key>/
+	DerivativesPrefix = "derivatives/"
+)
 
 type Storage interface {
-	GetUserById(id int) (types.User, error)
-	GetUserByEmail(email string) (types.User, error)
-	CreateUser(email, password string) error
+	GetUserById(ctx context.Context, id int) (types.User, error)
+	// GetUserByEmail looks the user up by email, ignoring case
+	GetUserByEmail(ctx context.Context, email string) (types.User, error)
+	// CreateUser returns ErrDuplicateEmail if the email is registered in any case
+	CreateUser(ctx context.Context, email, password string) error
+	// UpdatePassword replaces the password and records when it changed in PasswordChangedAt
+	UpdatePassword(ctx context.Context, userID int, password string) error
+	MarkEmailVerified(ctx context.Context, userID int) error
+	// SetStripMetadata chooses whether metadata is removed from the stored copy of the user's uploads
+	SetStripMetadata(ctx context.Context, userID int, strip bool) error
+
+	// CreateAccountToken stores the hash of a single-use token issued for purpose
+	CreateAccountToken(ctx context.Context, userID int, purpose, tokenHash string, expiresAt time.Time) error
+	// ConsumeAccountToken marks an unused, unexpired token as used and returns its owner
+	ConsumeAccountToken(ctx context.Context, purpose, tokenHash string) (int, error)
+	// DeleteAccountTokens deletes the user's unused tokens for purpose
+	DeleteAccountTokens(ctx context.Context, userID int, purpose string) error
+
+	// GetUserByIdentity returns the user linked to an external (OIDC) account
+	GetUserByIdentity(ctx context.Context, provider, subject string) (types.User, error)
+	LinkIdentity(ctx context.Context, userID int, provider, subject, email string) error
+	// ListIdentities returns the external accounts linked to the user, oldest first
+	ListIdentities(ctx context.Context, userID int) ([]types.Identity, error)
+
+	// DeleteUser deletes the user and every row that belongs to them, keeping only the returned
+	// record of the deletion; it returns sql.ErrNoRows if there is no such user
+	DeleteUser(ctx context.Context, userID int) (types.AccountDeletion, error)
+	// PendingAccountPurges returns up to limit deleted accounts whose files haven't been removed, oldest first
+	PendingAccountPurges(ctx context.Context, limit int) ([]types.AccountDeletion, error)
+	// MarkAccountPurged records that the files of a deleted account are gone
+	MarkAccountPurged(ctx context.Context, deletionID int) error
+
+	// SetTOTPSecret stores a pending secret; it only protects sign-in once EnableTOTP is called
+	SetTOTPSecret(ctx context.Context, userID int, secret string) error
+	EnableTOTP(ctx context.Context, userID int) error
+	// UseTOTPStep records that a code of the given time step was accepted, returning sql.ErrNoRows if
+	// a code of that step or a later one already was
+	UseTOTPStep(ctx context.Context, userID int, step int64) error
+	// DisableTOTP turns 2FA off, discarding the secret and the recovery codes
+	DisableTOTP(ctx context.Context, userID int) error
+	// ReplaceRecoveryCodes discards any previous recovery codes and stores the given hashes
+	ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error
+	// UseRecoveryCode marks an unused recovery code as used, returning sql.ErrNoRows if there is none
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) error
+
+	// CreatePhoto adds an uploaded object to the photo catalog
+	CreatePhoto(ctx context.Context, userID int, key string, size int64) error
+	// TrashPhoto marks a photo as deleted, adding it to the catalog if it predates it
+	TrashPhoto(ctx context.Context, userID int, key string) error
+	// RestorePhoto clears the deletion mark, returning sql.ErrNoRows if the photo isn't in the user's trash
+	RestorePhoto(ctx context.Context, userID int, key string) error
+	// ListTrash returns the user's deleted photos, most recently deleted first
+	ListTrash(ctx context.Context, userID int) ([]types.TrashedPhoto, error)
+	// ExpiredTrash returns up to limit photos deleted before the given time
+	ExpiredTrash(ctx context.Context, before time.Time, limit int) ([]types.TrashedPhoto, error)
+	// DeletePhoto removes a photo from the catalog and from every album for good
+	DeletePhoto(ctx context.Context, key string) error
+	// GetPhoto returns a catalogued photo of the user that isn't in the trash
+	GetPhoto(ctx context.Context, userID int, key string) (types.PhotoDetails, error)
+	// UpdatePhotoMetadata replaces the metadata of a catalogued photo, returning sql.ErrNoRows if there is none
+	UpdatePhotoMetadata(ctx context.Context, userID int, key string, meta types.PhotoMetadata) error
+	// SearchPhotos returns the user's photos matching the query, best matches first
+	SearchPhotos(ctx context.Context, userID int, query PhotoQuery) ([]types.PhotoDetails, error)
+	// SetPhotoHash records the perceptual hash of a catalogued photo
+	SetPhotoHash(ctx context.Context, key string, hash uint64) error
+	// SimilarPhotos returns the user's photos whose hash is at most maxDistance bits from hash,
+	// closest first, leaving out those in the trash
+	SimilarPhotos(ctx context.Context, userID int, hash uint64, maxDistance, limit int) ([]types.SimilarPhoto, error)
+	// SetPhotoChecksum records the SHA-256 of the uploaded content of a catalogued photo
+	SetPhotoChecksum(ctx context.Context, key, checksum string) error
+	// PhotoWithChecksum returns the key of a photo of the user with the given checksum, leaving out
+	// those in the trash, or sql.ErrNoRows if there is none
+	PhotoWithChecksum(ctx context.Context, userID int, checksum string) (string, error)
+	// SetImageMetadata records what was extracted from a catalogued photo
+	SetImageMetadata(ctx context.Context, key string, meta types.ImageMetadata) error
+	// ImageMetadata returns the metadata of those keys that have any, whoever owns them
+	ImageMetadata(ctx context.Context, keys []string) (map[string]types.ImageMetadata, error)
+
+	// Album methods only act on albums owned by userID and return sql.ErrNoRows for any other
+	CreateAlbum(ctx context.Context, userID int, name string) (types.Album, error)
+	ListAlbums(ctx context.Context, userID int) ([]types.Album, error)
+	GetAlbum(ctx context.Context, userID, albumID int) (types.Album, error)
+	RenameAlbum(ctx context.Context, userID, albumID int, name string) error
+	DeleteAlbum(ctx context.Context, userID, albumID int) error
+	// SetAlbumCover makes key the cover, which must be a photo of the album outside the trash; an empty key clears it
+	SetAlbumCover(ctx context.Context, userID, albumID int, key string) error
+	// AddAlbumPhotos appends keys to the album, skipping those already in it; every key must be a
+	// catalogued photo of the user outside the trash, or nothing is added and ErrPhotoNotFound is returned
+	AddAlbumPhotos(ctx context.Context, userID, albumID int, keys []string) error
+	RemoveAlbumPhoto(ctx context.Context, userID, albumID int, key string) error
+	// ReorderAlbumPhotos sets the photo order; keys must list every photo of the album exactly once
+	ReorderAlbumPhotos(ctx context.Context, userID, albumID int, keys []string) error
+	// AlbumPhotos returns the photos of an album in order, leaving out those in the trash or no longer
+	// in the owner's catalog
+	AlbumPhotos(ctx context.Context, userID, albumID int) ([]types.ImageInfo, error)
+
+	// CreateShare stores a new share link, returning it with its ID and creation time
+	CreateShare(ctx context.Context, share types.Share) (types.Share, error)
+	// ListShares returns the user's share links, newest first
+	ListShares(ctx context.Context, userID int) ([]types.Share, error)
+	// GetShare looks a share up by its slug, whoever owns it
+	GetShare(ctx context.Context, slug string) (types.Share, error)
+	// DeleteShare only deletes shares owned by userID and returns sql.ErrNoRows for any other
+	DeleteShare(ctx context.Context, userID, shareID int) error
+	RecordShareView(ctx context.Context, shareID int) error
+	// RecordShareDownload counts a download, returning ErrShareExhausted once the limit is reached
+	RecordShareDownload(ctx context.Context, shareID int) error
+
+	// CreateExport records a request to download the user's library, returning it with its ID
+	CreateExport(ctx context.Context, userID int, expiresAt time.Time) (types.Export, error)
+	// GetExport only returns exports of userID and sql.ErrNoRows for any other
+	GetExport(ctx context.Context, userID, exportID int) (types.Export, error)
+	// CompleteExport records the first time an export was downloaded in full
+	CompleteExport(ctx context.Context, exportID int) error
 }
 
 type S3 interface {
-	DownloadPhotoByKey(key string) ([]byte, error)
+	DownloadPhotoByKey(ctx context.Context, key string) ([]byte, error)
 	//GetWEBPPhotoByKey(key string) ([]byte, error)
-	DownloadSmallPhotoByKey(key string) ([]byte, error)
-	GetLastXPhotosForUser(userID string, photoNum int64) ([]types.ImageInfo, error)
-	GetLastPhotoForUser(userID string) (types.ImageInfo, error)
+	DownloadSmallPhotoByKey(ctx context.Context, key string) ([]byte, error)
+	GetLastXPhotosForUser(ctx context.Context, userID string, photoNum int64) ([]types.ImageInfo, error)
+	GetLastPhotoForUser(ctx context.Context, userID string) (types.ImageInfo, error)
+	// PresignURL returns a temporary link to key that is valid for ttl, and when it expires
+	// A ttl of zero uses the configured lifetime of listed URLs.
+	PresignURL(ctx context.Context, key string, ttl time.Duration) (string, time.Time, error)
+	// UploadPhoto stores data as user_<userID>/<name>; cached listings of the user are invalidated
+	UploadPhoto(ctx context.Context, userID, name string, data []byte) (types.ImageInfo, error)
+
+	// TrashPhoto moves key to the trash prefix, returning ErrPhotoNotFound if there is no such photo
+	TrashPhoto(ctx context.Context, userID, key string) error
+	// RestorePhoto moves key back out of the trash
+	RestorePhoto(ctx context.Context, userID, key string) error
+	// PurgePhoto permanently deletes a trashed photo and its derivatives
+	PurgePhoto(ctx context.Context, key string) error
+	// PurgeUser permanently deletes every object of a user, in the trash and derivatives too
+	PurgeUser(ctx context.Context, userID string) error
+
+	// WalkPhotos calls fn for each image under user_<userID>/ while the store is being listed,
+	// stopping at and returning the first error from fn
+	WalkPhotos(ctx context.Context, userID string, fn func(types.ImageInfo) error) error
+	// OpenPhoto streams the object at key, returning ErrPhotoNotFound if there is none
+	OpenPhoto(ctx context.Context, key string) (io.ReadCloser, error)
 }
@@ -0,0 +1,1089 @@
+// Package storagetest is a conformance suite for storage.Storage implementations
+//
+// Every implementation should pass it, which keeps the in-memory store
+// interchangeable with Postgres:
+//
+//	func TestMemory(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return storage.NewMemory()
+//		})
+//	}
+//
+// Implementations backed by a shared database should hand out a fresh, migrated
+// schema from newStorage; the suite does not clean up after itself.
+package storagetest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alvarofc/mode/storage"
+	"github.com/alvarofc/mode/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var emailCounter atomic.Int64
+
+// uniqueEmail keeps tests independent when implementations share state
+func uniqueEmail() string {
+	return fmt.Sprintf("user%d-%d@example.com", time.Now().UnixNano(), emailCounter.Add(1))
+}
+
+// Run runs the conformance suite against the stores returned by newStorage
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storage)
+	}{
+		{"CreateUser", testCreateUser},
+		{"DuplicateEmail", testDuplicateEmail},
+		{"UnknownUser", testUnknownUser},
+		{"UpdatePassword", testUpdatePassword},
+		{"MarkEmailVerified", testMarkEmailVerified},
+		{"StripMetadata", testStripMetadata},
+		{"AccountTokens", testAccountTokens},
+		{"Identities", testIdentities},
+		{"TOTP", testTOTP},
+		{"RecoveryCodes", testRecoveryCodes},
+		{"Trash", testTrash},
+		{"Albums", testAlbums},
+		{"Search", testSearch},
+		{"Shares", testShares},
+		{"PhotoHashes", testPhotoHashes},
+		{"PhotoChecksums", testPhotoChecksums},
+		{"ImageMetadata", testImageMetadata},
+		{"Exports", testExports},
+		{"DeleteUser", testDeleteUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t))
+		})
+	}
+}
+
+func createUser(t *testing.T, s storage.Storage) (int, string) {
+	t.Helper()
+	ctx := context.Background()
+
+	email := uniqueEmail()
+	if err := s.CreateUser(ctx, email, "correct horse"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	user, err := s.GetUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	return user.ID, email
+}
+
+func testCreateUser(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, email := createUser(t, s)
+
+	user, err := s.GetUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	if user.ID != id || user.Email != email {
+		t.Errorf("GetUserByEmail = %+v, want id %d and email %s", user, id, email)
+	}
+	if user.Password == "correct horse" {
+		t.Fatal("password stored in plain text")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("correct horse")); err != nil {
+		t.Errorf("stored password is not a bcrypt hash of the original: %v", err)
+	}
+	if user.EmailVerified || user.TOTPEnabled {
+		t.Errorf("new user should be unverified without 2FA, got %+v", user)
+	}
+
+	byID, err := s.GetUserById(ctx, id)
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+	if byID.ID != id || byID.Email != email {
+		t.Errorf("GetUserById = %+v, want id %d and email %s", byID, id, email)
+	}
+}
+
+func testDuplicateEmail(t *testing.T, s storage.Storage) {
+	_, email := createUser(t, s)
+
+	err := s.CreateUser(context.Background(), email, "another password")
+	if !errors.Is(err, storage.ErrDuplicateEmail) {
+		t.Errorf("CreateUser with a registered email = %v, want ErrDuplicateEmail", err)
+	}
+	err = s.CreateUser(context.Background(), strings.ToUpper(email), "another password")
+	if !errors.Is(err, storage.ErrDuplicateEmail) {
+		t.Errorf("CreateUser with a registered email in another case = %v, want ErrDuplicateEmail", err)
+	}
+
+	user, err := s.GetUserByEmail(context.Background(), strings.ToUpper(email))
+	if err != nil || user.Email != email {
+		t.Errorf("GetUserByEmail in another case = %+v, %v, want the user with email %s", user, err, email)
+	}
+}
+
+func testUnknownUser(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	if _, err := s.GetUserByEmail(ctx, uniqueEmail()); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByEmail for an unknown email = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.GetUserById(ctx, -1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserById for an unknown ID = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testUpdatePassword(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, email := createUser(t, s)
+
+	if user, _ := s.GetUserById(ctx, id); !user.PasswordChangedAt.IsZero() {
+		t.Errorf("new user has a password change time %v, want none", user.PasswordChangedAt)
+	}
+	before := time.Now().Add(-time.Minute)
+	if err := s.UpdatePassword(ctx, id, "battery staple"); err != nil {
+		t.Fatalf("UpdatePassword: %v", err)
+	}
+	user, err := s.GetUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("battery staple")); err != nil {
+		t.Errorf("new password doesn't match the stored hash: %v", err)
+	}
+	if user, _ := s.GetUserById(ctx, id); user.PasswordChangedAt.Before(before) {
+		t.Errorf("GetUserById password change time = %v, want about now", user.PasswordChangedAt)
+	}
+}
+
+func testMarkEmailVerified(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, email := createUser(t, s)
+
+	if err := s.MarkEmailVerified(ctx, id); err != nil {
+		t.Fatalf("MarkEmailVerified: %v", err)
+	}
+	user, err := s.GetUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	if !user.EmailVerified {
+		t.Error("email should be verified")
+	}
+}
+
+func testStripMetadata(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, email := createUser(t, s)
+
+	if user, _ := s.GetUserById(ctx, id); !user.StripMetadata {
+		t.Error("metadata stripping should be on for new users")
+	}
+
+	if err := s.SetStripMetadata(ctx, id, false); err != nil {
+		t.Fatalf("SetStripMetadata: %v", err)
+	}
+	if user, _ := s.GetUserByEmail(ctx, email); user.StripMetadata {
+		t.Error("metadata stripping should be off")
+	}
+
+	if err := s.SetStripMetadata(ctx, -1, true); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SetStripMetadata for an unknown user = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testAccountTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	suffix := uniqueEmail()
+
+	if err := s.CreateAccountToken(ctx, id, "verify_email", "valid"+suffix, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("CreateAccountToken: %v", err)
+	}
+	if err := s.CreateAccountToken(ctx, id, "verify_email", "expired"+suffix, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("CreateAccountToken: %v", err)
+	}
+
+	if _, err := s.ConsumeAccountToken(ctx, "password_reset", "valid"+suffix); err == nil {
+		t.Error("token redeemed for the wrong purpose")
+	}
+
+	userID, err := s.ConsumeAccountToken(ctx, "verify_email", "valid"+suffix)
+	if err != nil {
+		t.Fatalf("ConsumeAccountToken: %v", err)
+	}
+	if userID != id {
+		t.Errorf("ConsumeAccountToken = %d, want %d", userID, id)
+	}
+
+	if _, err := s.ConsumeAccountToken(ctx, "verify_email", "valid"+suffix); err == nil {
+		t.Error("token redeemed twice")
+	}
+	if _, err := s.ConsumeAccountToken(ctx, "verify_email", "expired"+suffix); err == nil {
+		t.Error("expired token redeemed")
+	}
+	if _, err := s.ConsumeAccountToken(ctx, "verify_email", "unknown"+suffix); err == nil {
+		t.Error("unknown token redeemed")
+	}
+
+	other, _ := createUser(t, s)
+	for _, token := range []struct {
+		userID  int
+		purpose string
+		hash    string
+	}{
+		{id, "password_reset", "reset1" + suffix},
+		{id, "password_reset", "reset2" + suffix},
+		{id, "verify_email", "verify" + suffix},
+		{other, "password_reset", "other" + suffix},
+	} {
+		if err := s.CreateAccountToken(ctx, token.userID, token.purpose, token.hash, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("CreateAccountToken(%s): %v", token.hash, err)
+		}
+	}
+	if err := s.DeleteAccountTokens(ctx, id, "password_reset"); err != nil {
+		t.Fatalf("DeleteAccountTokens: %v", err)
+	}
+	for _, hash := range []string{"reset1", "reset2"} {
+		if _, err := s.ConsumeAccountToken(ctx, "password_reset", hash+suffix); err == nil {
+			t.Errorf("deleted token %s redeemed", hash)
+		}
+	}
+	if _, err := s.ConsumeAccountToken(ctx, "verify_email", "verify"+suffix); err != nil {
+		t.Errorf("token for another purpose was deleted: %v", err)
+	}
+	if _, err := s.ConsumeAccountToken(ctx, "password_reset", "other"+suffix); err != nil {
+		t.Errorf("another user's token was deleted: %v", err)
+	}
+}
+
+func testIdentities(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, email := createUser(t, s)
+	subject := uniqueEmail()
+
+	if _, err := s.GetUserByIdentity(ctx, "mock", subject); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByIdentity before linking = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := s.LinkIdentity(ctx, id, "mock", subject, email); err != nil {
+		t.Fatalf("LinkIdentity: %v", err)
+	}
+	user, err := s.GetUserByIdentity(ctx, "mock", subject)
+	if err != nil {
+		t.Fatalf("GetUserByIdentity: %v", err)
+	}
+	if user.ID != id {
+		t.Errorf("GetUserByIdentity = user %d, want %d", user.ID, id)
+	}
+
+	other, _ := createUser(t, s)
+	if err := s.LinkIdentity(ctx, other, "mock", subject, email); err == nil {
+		t.Error("the same identity was linked to two users")
+	}
+	if _, err := s.GetUserByIdentity(ctx, "other", subject); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("identity matched across providers: %v", err)
+	}
+
+	identities, err := s.ListIdentities(ctx, id)
+	if err != nil {
+		t.Fatalf("ListIdentities: %v", err)
+	}
+	if len(identities) != 1 || identities[0].Provider != "mock" || identities[0].Subject != subject || identities[0].Email != email {
+		t.Errorf("ListIdentities = %+v, want the mock identity", identities)
+	}
+	if identities, _ := s.ListIdentities(ctx, other); len(identities) != 0 {
+		t.Errorf("ListIdentities for a user without identities = %+v", identities)
+	}
+}
+
+func testTOTP(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+
+	if err := s.EnableTOTP(ctx, id); err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+	if user, _ := s.GetUserById(ctx, id); user.TOTPEnabled {
+		t.Error("2FA enabled without a secret")
+	}
+
+	if err := s.SetTOTPSecret(ctx, id, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatalf("SetTOTPSecret: %v", err)
+	}
+	user, err := s.GetUserById(ctx, id)
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+	if user.TOTPSecret != "JBSWY3DPEHPK3PXP" || user.TOTPEnabled {
+		t.Errorf("after SetTOTPSecret got secret %q enabled %v, want pending secret", user.TOTPSecret, user.TOTPEnabled)
+	}
+
+	if err := s.EnableTOTP(ctx, id); err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+	if user, _ := s.GetUserById(ctx, id); !user.TOTPEnabled {
+		t.Error("2FA should be enabled")
+	}
+
+	// Sign-ins through a linked provider must see 2FA too
+	if err := s.LinkIdentity(ctx, id, "google", fmt.Sprintf("totp-%d", id), ""); err != nil {
+		t.Fatalf("LinkIdentity: %v", err)
+	}
+	if user, err := s.GetUserByIdentity(ctx, "google", fmt.Sprintf("totp-%d", id)); err != nil || !user.TOTPEnabled || user.TOTPSecret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("GetUserByIdentity = %+v, %v, want 2FA enabled with its secret", user, err)
+	}
+
+	if err := s.UseTOTPStep(ctx, id, 100); err != nil {
+		t.Fatalf("UseTOTPStep: %v", err)
+	}
+	for _, step := range []int64{100, 99} {
+		if err := s.UseTOTPStep(ctx, id, step); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("UseTOTPStep(%d) after 100 = %v, want sql.ErrNoRows", step, err)
+		}
+	}
+	if err := s.UseTOTPStep(ctx, id, 101); err != nil {
+		t.Errorf("UseTOTPStep with a later step: %v", err)
+	}
+
+	if err := s.ReplaceRecoveryCodes(ctx, id, []string{"a"}); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if err := s.DisableTOTP(ctx, id); err != nil {
+		t.Fatalf("DisableTOTP: %v", err)
+	}
+	if user, _ := s.GetUserById(ctx, id); user.TOTPEnabled || user.TOTPSecret != "" {
+		t.Errorf("after DisableTOTP got secret %q enabled %v, want neither", user.TOTPSecret, user.TOTPEnabled)
+	}
+	if err := s.UseRecoveryCode(ctx, id, "a"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("recovery code usable after DisableTOTP: %v", err)
+	}
+}
+
+func testRecoveryCodes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+
+	if err := s.ReplaceRecoveryCodes(ctx, id, []string{"a", "b"}); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if err := s.UseRecoveryCode(ctx, id, "a"); err != nil {
+		t.Fatalf("UseRecoveryCode: %v", err)
+	}
+	if err := s.UseRecoveryCode(ctx, id, "a"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("reusing a recovery code = %v, want sql.ErrNoRows", err)
+	}
+
+	other, _ := createUser(t, s)
+	if err := s.UseRecoveryCode(ctx, other, "b"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("recovery code used by another user = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := s.ReplaceRecoveryCodes(ctx, id, []string{"c"}); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if err := s.UseRecoveryCode(ctx, id, "b"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("replaced recovery code still usable: %v", err)
+	}
+	if err := s.UseRecoveryCode(ctx, id, "c"); err != nil {
+		t.Errorf("UseRecoveryCode: %v", err)
+	}
+}
+
+func testTrash(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	other, _ := createUser(t, s)
+	prefix := fmt.Sprintf("user_%d/", id)
+
+	if err := s.CreatePhoto(ctx, id, prefix+"a.png", 10); err != nil {
+		t.Fatalf("CreatePhoto: %v", err)
+	}
+	if err := s.CreatePhoto(ctx, id, prefix+"a.png", 10); err == nil {
+		t.Error("the same key was added to the catalog twice")
+	}
+
+	if err := s.TrashPhoto(ctx, id, prefix+"a.png"); err != nil {
+		t.Fatalf("TrashPhoto: %v", err)
+	}
+	// Photos uploaded before the catalog existed can still be trashed
+	if err := s.TrashPhoto(ctx, id, prefix+"legacy.png"); err != nil {
+		t.Fatalf("TrashPhoto for an uncatalogued photo: %v", err)
+	}
+
+	trash, err := s.ListTrash(ctx, id)
+	if err != nil {
+		t.Fatalf("ListTrash: %v", err)
+	}
+	if len(trash) != 2 || trash[0].Key != prefix+"legacy.png" || trash[1].Key != prefix+"a.png" {
+		t.Errorf("ListTrash = %+v, want legacy.png then a.png", trash)
+	}
+	if trash[1].Size != 10 || trash[1].UserID != id || trash[1].DeletedAt.IsZero() {
+		t.Errorf("trashed photo = %+v, want size 10, owner %d and a deletion time", trash[1], id)
+	}
+	if trash, _ := s.ListTrash(ctx, other); len(trash) != 0 {
+		t.Errorf("another user's trash lists %d photos", len(trash))
+	}
+
+	if err := s.RestorePhoto(ctx, other, prefix+"a.png"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RestorePhoto by another user = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.RestorePhoto(ctx, id, prefix+"a.png"); err != nil {
+		t.Fatalf("RestorePhoto: %v", err)
+	}
+	if err := s.RestorePhoto(ctx, id, prefix+"a.png"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RestorePhoto of a photo that isn't trashed = %v, want sql.ErrNoRows", err)
+	}
+
+	expired, err := s.ExpiredTrash(ctx, time.Now().Add(time.Minute), 1000)
+	if err != nil {
+		t.Fatalf("ExpiredTrash: %v", err)
+	}
+	found := false
+	for _, photo := range expired {
+		if photo.Key == prefix+"a.png" {
+			t.Error("restored photo is listed as expired")
+		}
+		found = found || photo.Key == prefix+"legacy.png"
+	}
+	if !found {
+		t.Error("trashed photo is not listed as expired")
+	}
+	expired, err = s.ExpiredTrash(ctx, time.Now().Add(-time.Hour), 1000)
+	if err != nil {
+		t.Fatalf("ExpiredTrash: %v", err)
+	}
+	for _, photo := range expired {
+		if photo.UserID == id {
+			t.Errorf("photo %s deleted just now is already expired", photo.Key)
+		}
+	}
+
+	if err := s.DeletePhoto(ctx, prefix+"legacy.png"); err != nil {
+		t.Fatalf("DeletePhoto: %v", err)
+	}
+	if trash, _ := s.ListTrash(ctx, id); len(trash) != 0 {
+		t.Errorf("ListTrash after DeletePhoto = %+v, want nothing", trash)
+	}
+}
+
+func albumKeys(t *testing.T, s storage.Storage, userID, albumID int) string {
+	t.Helper()
+	photos, err := s.AlbumPhotos(context.Background(), userID, albumID)
+	if err != nil {
+		t.Fatalf("AlbumPhotos: %v", err)
+	}
+	var keys []string
+	for _, photo := range photos {
+		keys = append(keys, photo.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+func testAlbums(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	other, _ := createUser(t, s)
+
+	album, err := s.CreateAlbum(ctx, id, "Holidays")
+	if err != nil {
+		t.Fatalf("CreateAlbum: %v", err)
+	}
+	if album.ID == 0 || album.Name != "Holidays" || album.UserID != id {
+		t.Errorf("CreateAlbum = %+v", album)
+	}
+
+	if _, err := s.GetAlbum(ctx, other, album.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetAlbum by another user = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.RenameAlbum(ctx, other, album.ID, "Mine"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RenameAlbum by another user = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.AddAlbumPhotos(ctx, other, album.ID, []string{"x"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("AddAlbumPhotos by another user = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := s.RenameAlbum(ctx, id, album.ID, "Summer"); err != nil {
+		t.Fatalf("RenameAlbum: %v", err)
+	}
+
+	a, b, c := fmt.Sprintf("user_%d/a.png", id), fmt.Sprintf("user_%d/b.png", id), fmt.Sprintf("user_%d/c.png", id)
+	for _, key := range []string{a, b, c} {
+		if err := s.CreatePhoto(ctx, id, key, 10); err != nil {
+			t.Fatalf("CreatePhoto: %v", err)
+		}
+	}
+	foreign := fmt.Sprintf("user_%d/../user_%d/x.png", id, other)
+	if err := s.CreatePhoto(ctx, other, fmt.Sprintf("user_%d/x.png", other), 10); err != nil {
+		t.Fatalf("CreatePhoto: %v", err)
+	}
+	for _, key := range []string{fmt.Sprintf("user_%d/x.png", other), foreign, fmt.Sprintf("user_%d/uncatalogued.png", id)} {
+		if err := s.AddAlbumPhotos(ctx, id, album.ID, []string{a, key}); !errors.Is(err, storage.ErrPhotoNotFound) {
+			t.Errorf("AddAlbumPhotos with %s = %v, want ErrPhotoNotFound", key, err)
+		}
+	}
+	if got := albumKeys(t, s, id, album.ID); got != "" {
+		t.Errorf("AlbumPhotos after rejected additions = %s, want nothing", got)
+	}
+
+	if err := s.AddAlbumPhotos(ctx, id, album.ID, []string{a, b}); err != nil {
+		t.Fatalf("AddAlbumPhotos: %v", err)
+	}
+	if err := s.AddAlbumPhotos(ctx, id, album.ID, []string{b, c}); err != nil {
+		t.Fatalf("AddAlbumPhotos: %v", err)
+	}
+	if got, want := albumKeys(t, s, id, album.ID), strings.Join([]string{a, b, c}, ","); got != want {
+		t.Errorf("AlbumPhotos = %s, want %s", got, want)
+	}
+
+	if err := s.ReorderAlbumPhotos(ctx, id, album.ID, []string{c, a}); !errors.Is(err, storage.ErrInvalidOrder) {
+		t.Errorf("ReorderAlbumPhotos with a missing key = %v, want ErrInvalidOrder", err)
+	}
+	if err := s.ReorderAlbumPhotos(ctx, id, album.ID, []string{c, a, a}); !errors.Is(err, storage.ErrInvalidOrder) {
+		t.Errorf("ReorderAlbumPhotos with a duplicate key = %v, want ErrInvalidOrder", err)
+	}
+	if err := s.ReorderAlbumPhotos(ctx, id, album.ID, []string{c, a, b}); err != nil {
+		t.Fatalf("ReorderAlbumPhotos: %v", err)
+	}
+	if got, want := albumKeys(t, s, id, album.ID), strings.Join([]string{c, a, b}, ","); got != want {
+		t.Errorf("AlbumPhotos after reordering = %s, want %s", got, want)
+	}
+
+	if err := s.SetAlbumCover(ctx, id, album.ID, "user_0/elsewhere.png"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SetAlbumCover with a photo outside the album = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.SetAlbumCover(ctx, id, album.ID, a); err != nil {
+		t.Fatalf("SetAlbumCover: %v", err)
+	}
+
+	got, err := s.GetAlbum(ctx, id, album.ID)
+	if err != nil {
+		t.Fatalf("GetAlbum: %v", err)
+	}
+	if got.Name != "Summer" || got.CoverKey != a || got.PhotoCount != 3 {
+		t.Errorf("GetAlbum = %+v, want Summer with cover %s and 3 photos", got, a)
+	}
+
+	// Trashed photos are hidden, purged ones are removed along with the cover
+	if err := s.TrashPhoto(ctx, id, b); err != nil {
+		t.Fatalf("TrashPhoto: %v", err)
+	}
+	if got, want := albumKeys(t, s, id, album.ID), strings.Join([]string{c, a}, ","); got != want {
+		t.Errorf("AlbumPhotos with a trashed photo = %s, want %s", got, want)
+	}
+	if err := s.DeletePhoto(ctx, a); err != nil {
+		t.Fatalf("DeletePhoto: %v", err)
+	}
+	if got, _ := s.GetAlbum(ctx, id, album.ID); got.CoverKey != "" || got.PhotoCount != 1 {
+		t.Errorf("GetAlbum after purging the cover = %+v, want no cover and 1 photo", got)
+	}
+
+	if err := s.RemoveAlbumPhoto(ctx, id, album.ID, c); err != nil {
+		t.Fatalf("RemoveAlbumPhoto: %v", err)
+	}
+	if err := s.RemoveAlbumPhoto(ctx, id, album.ID, c); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RemoveAlbumPhoto of a photo not in the album = %v, want sql.ErrNoRows", err)
+	}
+
+	if albums, _ := s.ListAlbums(ctx, other); len(albums) != 0 {
+		t.Errorf("ListAlbums for another user = %+v, want nothing", albums)
+	}
+	if err := s.DeleteAlbum(ctx, other, album.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeleteAlbum by another user = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.DeleteAlbum(ctx, id, album.ID); err != nil {
+		t.Fatalf("DeleteAlbum: %v", err)
+	}
+	if albums, _ := s.ListAlbums(ctx, id); len(albums) != 0 {
+		t.Errorf("ListAlbums after deleting = %+v, want nothing", albums)
+	}
+}
+
+// searchKeys returns the keys found by SearchPhotos, in order
+func searchKeys(t *testing.T, s storage.Storage, userID int, query storage.PhotoQuery) []string {
+	t.Helper()
+	photos, err := s.SearchPhotos(context.Background(), userID, query)
+	if err != nil {
+		t.Fatalf("SearchPhotos(%+v): %v", query, err)
+	}
+	keys := []string{}
+	for _, photo := range photos {
+		keys = append(keys, path.Base(photo.Key))
+	}
+	return keys
+}
+
+func testSearch(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	other, _ := createUser(t, s)
+	prefix := fmt.Sprintf("user_%d/", id)
+
+	for _, photo := range []struct {
+		key  string
+		size int64
+		meta types.PhotoMetadata
+	}{
+		{"cat.png", 100, types.PhotoMetadata{
+			Source: types.PhotoSourceGenerated,
+			Prompt: "An orange cat sleeping on a windowsill",
+			GenerationParams: map[string]interface{}{
+				"model": "sdxl",
+				"steps": float64(30),
+			},
+			Tags: []string{"pets"},
+		}},
+		{"dog.png", 200, types.PhotoMetadata{
+			Source: types.PhotoSourceGenerated,
+			Prompt: "A dog chasing a cat through a garden",
+		}},
+		{"holiday.png", 300, types.PhotoMetadata{Source: types.PhotoSourceUpload, Tags: []string{"cat", "beach"}}},
+		{"plain.png", 400, types.PhotoMetadata{}},
+	} {
+		if err := s.CreatePhoto(ctx, id, prefix+photo.key, photo.size); err != nil {
+			t.Fatalf("CreatePhoto(%s): %v", photo.key, err)
+		}
+		if photo.meta.Source == "" {
+			continue
+		}
+		if err := s.UpdatePhotoMetadata(ctx, id, prefix+photo.key, photo.meta); err != nil {
+			t.Fatalf("UpdatePhotoMetadata(%s): %v", photo.key, err)
+		}
+	}
+
+	details, err := s.GetPhoto(ctx, id, prefix+"cat.png")
+	if err != nil {
+		t.Fatalf("GetPhoto: %v", err)
+	}
+	if details.Size != 100 || details.Source != types.PhotoSourceGenerated ||
+		details.GenerationParams["model"] != "sdxl" || details.GenerationParams["steps"] != float64(30) ||
+		len(details.Tags) != 1 || details.Tags[0] != "pets" {
+		t.Errorf("GetPhoto = %+v, want the stored metadata", details)
+	}
+	if details, _ := s.GetPhoto(ctx, id, prefix+"plain.png"); details.Source != types.PhotoSourceUpload {
+		t.Errorf("source of a new photo = %q, want %q", details.Source, types.PhotoSourceUpload)
+	}
+	if _, err := s.GetPhoto(ctx, other, prefix+"cat.png"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetPhoto by another user = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.UpdatePhotoMetadata(ctx, other, prefix+"cat.png", types.PhotoMetadata{Source: types.PhotoSourceUpload}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("UpdatePhotoMetadata by another user = %v, want sql.ErrNoRows", err)
+	}
+
+	// A tag match ranks above a prompt match
+	if got := strings.Join(searchKeys(t, s, id, storage.PhotoQuery{Text: "cat"}), ","); got != "holiday.png,dog.png,cat.png" &&
+		got != "holiday.png,cat.png,dog.png" {
+		t.Errorf("search for cat = %s, want holiday.png first and then both prompts", got)
+	}
+	if got := strings.Join(searchKeys(t, s, id, storage.PhotoQuery{Text: "cats sleeping"}), ","); got != "cat.png" {
+		t.Errorf("search for cats sleeping = %s, want cat.png", got)
+	}
+	if got := strings.Join(searchKeys(t, s, id, storage.PhotoQuery{Text: "cat -dog"}), ","); strings.Contains(got, "dog.png") {
+		t.Errorf("search excluding dog = %s", got)
+	}
+	if got := searchKeys(t, s, other, storage.PhotoQuery{Text: "cat"}); len(got) != 0 {
+		t.Errorf("another user's search = %v, want nothing", got)
+	}
+
+	for _, tt := range []struct {
+		query storage.PhotoQuery
+		want  string
+	}{
+		{storage.PhotoQuery{Text: "cat", Source: types.PhotoSourceUpload}, "holiday.png"},
+		{storage.PhotoQuery{Tags: []string{"cat", "beach"}}, "holiday.png"},
+		{storage.PhotoQuery{MinSize: 200, MaxSize: 300, Text: "cat"}, "holiday.png,dog.png"},
+		{storage.PhotoQuery{From: time.Now().Add(time.Hour)}, ""},
+		{storage.PhotoQuery{To: time.Now().Add(-time.Hour)}, ""},
+		{storage.PhotoQuery{Text: "cat", MinSize: 200, Limit: 1, Offset: 1}, "dog.png"},
+	} {
+		if got := strings.Join(searchKeys(t, s, id, tt.query), ","); got != tt.want {
+			t.Errorf("SearchPhotos(%+v) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+	if got := searchKeys(t, s, id, storage.PhotoQuery{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}); len(got) != 4 {
+		t.Errorf("search by date = %v, want all 4 photos", got)
+	}
+
+	if err := s.TrashPhoto(ctx, id, prefix+"holiday.png"); err != nil {
+		t.Fatalf("TrashPhoto: %v", err)
+	}
+	if got := strings.Join(searchKeys(t, s, id, storage.PhotoQuery{Tags: []string{"beach"}}), ","); got != "" {
+		t.Errorf("search finds trashed photos: %s", got)
+	}
+}
+
+func testShares(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	other, _ := createUser(t, s)
+	album, err := s.CreateAlbum(ctx, id, "Shared")
+	if err != nil {
+		t.Fatalf("CreateAlbum: %v", err)
+	}
+
+	slug := fmt.Sprintf("photo-%d", id)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	photo, err := s.CreateShare(ctx, types.Share{
+		Slug:         slug,
+		UserID:       id,
+		PhotoKey:     fmt.Sprintf("user_%d/a.png", id),
+		PasswordHash: "hash",
+		ExpiresAt:    &expires,
+		MaxDownloads: 2,
+	})
+	if err != nil {
+		t.Fatalf("CreateShare: %v", err)
+	}
+	if photo.ID == 0 || photo.CreatedAt.IsZero() {
+		t.Errorf("CreateShare = %+v, want an ID and a creation time", photo)
+	}
+	albumShare, err := s.CreateShare(ctx, types.Share{Slug: fmt.Sprintf("album-%d", id), UserID: id, AlbumID: album.ID})
+	if err != nil {
+		t.Fatalf("CreateShare for an album: %v", err)
+	}
+	if _, err := s.CreateShare(ctx, types.Share{Slug: slug, UserID: id, AlbumID: album.ID}); err == nil {
+		t.Error("two shares were created with the same slug")
+	}
+
+	got, err := s.GetShare(ctx, slug)
+	if err != nil {
+		t.Fatalf("GetShare: %v", err)
+	}
+	if got.ID != photo.ID || got.UserID != id || got.PhotoKey != photo.PhotoKey || got.AlbumID != 0 ||
+		got.PasswordHash != "hash" || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) || got.MaxDownloads != 2 {
+		t.Errorf("GetShare = %+v, want %+v", got, photo)
+	}
+	if _, err := s.GetShare(ctx, "missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetShare of an unknown slug = %v, want sql.ErrNoRows", err)
+	}
+
+	shares, err := s.ListShares(ctx, id)
+	if err != nil {
+		t.Fatalf("ListShares: %v", err)
+	}
+	if len(shares) != 2 || shares[0].ID != albumShare.ID || shares[1].ID != photo.ID {
+		t.Errorf("ListShares = %+v, want the album share then the photo share", shares)
+	}
+	if shares, _ := s.ListShares(ctx, other); len(shares) != 0 {
+		t.Errorf("another user lists %d shares", len(shares))
+	}
+
+	if err := s.RecordShareView(ctx, photo.ID); err != nil {
+		t.Fatalf("RecordShareView: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.RecordShareDownload(ctx, photo.ID); err != nil {
+			t.Fatalf("RecordShareDownload %d: %v", i+1, err)
+		}
+	}
+	if err := s.RecordShareDownload(ctx, photo.ID); !errors.Is(err, storage.ErrShareExhausted) {
+		t.Errorf("RecordShareDownload past the limit = %v, want storage.ErrShareExhausted", err)
+	}
+	if err := s.RecordShareDownload(ctx, albumShare.ID); err != nil {
+		t.Errorf("RecordShareDownload without a limit: %v", err)
+	}
+	if got, _ := s.GetShare(ctx, slug); got.Views != 1 || got.Downloads != 2 {
+		t.Errorf("share counts = %d views and %d downloads, want 1 and 2", got.Views, got.Downloads)
+	}
+
+	if err := s.DeleteShare(ctx, other, photo.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeleteShare by another user = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.DeleteShare(ctx, id, photo.ID); err != nil {
+		t.Fatalf("DeleteShare: %v", err)
+	}
+	if _, err := s.GetShare(ctx, slug); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetShare after deleting = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.RecordShareDownload(ctx, photo.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RecordShareDownload of a deleted share = %v, want sql.ErrNoRows", err)
+	}
+
+	// Deleting an album takes its shares with it
+	if err := s.DeleteAlbum(ctx, id, album.ID); err != nil {
+		t.Fatalf("DeleteAlbum: %v", err)
+	}
+	if _, err := s.GetShare(ctx, albumShare.Slug); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetShare of a deleted album's share = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testPhotoHashes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	other, _ := createUser(t, s)
+	prefix := fmt.Sprintf("user_%d/", id)
+
+	// The high bit checks that hashes survive the conversion to a signed column
+	const hash = uint64(0xf0f0f0f0f0f0f0f0)
+	for key, h := range map[string]uint64{
+		"same.png":  hash,
+		"near.png":  hash ^ 0b111,
+		"far.png":   ^hash,
+		"trash.png": hash,
+	} {
+		if err := s.CreatePhoto(ctx, id, prefix+key, 10); err != nil {
+			t.Fatalf("CreatePhoto(%s): %v", key, err)
+		}
+		if err := s.SetPhotoHash(ctx, prefix+key, h); err != nil {
+			t.Fatalf("SetPhotoHash(%s): %v", key, err)
+		}
+	}
+	if err := s.CreatePhoto(ctx, id, prefix+"unhashed.png", 10); err != nil {
+		t.Fatalf("CreatePhoto: %v", err)
+	}
+	if err := s.TrashPhoto(ctx, id, prefix+"trash.png"); err != nil {
+		t.Fatalf("TrashPhoto: %v", err)
+	}
+	if err := s.SetPhotoHash(ctx, prefix+"missing.png", hash); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SetPhotoHash of a missing photo = %v, want sql.ErrNoRows", err)
+	}
+
+	details, err := s.GetPhoto(ctx, id, prefix+"same.png")
+	if err != nil {
+		t.Fatalf("GetPhoto: %v", err)
+	}
+	if details.Hash == nil || *details.Hash != hash {
+		t.Errorf("GetPhoto hash = %v, want %x", details.Hash, hash)
+	}
+	if details, _ := s.GetPhoto(ctx, id, prefix+"unhashed.png"); details.Hash != nil {
+		t.Errorf("GetPhoto hash of an unhashed photo = %x, want nil", *details.Hash)
+	}
+
+	similar, err := s.SimilarPhotos(ctx, id, hash, 5, 10)
+	if err != nil {
+		t.Fatalf("SimilarPhotos: %v", err)
+	}
+	if len(similar) != 2 || path.Base(similar[0].Key) != "same.png" || similar[0].Distance != 0 ||
+		path.Base(similar[1].Key) != "near.png" || similar[1].Distance != 3 || similar[1].Size != 10 {
+		t.Errorf("SimilarPhotos = %+v, want same.png at 0 and near.png at 3", similar)
+	}
+	if similar, _ := s.SimilarPhotos(ctx, id, hash, 64, 1); len(similar) != 1 {
+		t.Errorf("SimilarPhotos with a limit of 1 returned %d photos", len(similar))
+	}
+	if similar, _ := s.SimilarPhotos(ctx, id, hash, 64, 10); len(similar) != 3 || similar[2].Distance != 64 {
+		t.Errorf("SimilarPhotos at any distance = %+v, want 3 photos ending with far.png", similar)
+	}
+	if similar, _ := s.SimilarPhotos(ctx, other, hash, 64, 10); len(similar) != 0 {
+		t.Errorf("another user's SimilarPhotos = %+v, want nothing", similar)
+	}
+}
+
+func testPhotoChecksums(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	other, _ := createUser(t, s)
+	prefix := fmt.Sprintf("user_%d/", id)
+
+	for _, key := range []string{"a.png", "b.png", "trash.png"} {
+		if err := s.CreatePhoto(ctx, id, prefix+key, 10); err != nil {
+			t.Fatalf("CreatePhoto(%s): %v", key, err)
+		}
+	}
+	for key, checksum := range map[string]string{"a.png": "aaaa", "b.png": "bbbb", "trash.png": "cccc"} {
+		if err := s.SetPhotoChecksum(ctx, prefix+key, checksum); err != nil {
+			t.Fatalf("SetPhotoChecksum(%s): %v", key, err)
+		}
+	}
+	if err := s.TrashPhoto(ctx, id, prefix+"trash.png"); err != nil {
+		t.Fatalf("TrashPhoto: %v", err)
+	}
+	if err := s.SetPhotoChecksum(ctx, prefix+"missing.png", "dddd"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SetPhotoChecksum of a missing photo = %v, want sql.ErrNoRows", err)
+	}
+
+	if key, err := s.PhotoWithChecksum(ctx, id, "bbbb"); err != nil || key != prefix+"b.png" {
+		t.Errorf("PhotoWithChecksum = %q, %v, want b.png", key, err)
+	}
+	if _, err := s.PhotoWithChecksum(ctx, id, "cccc"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("PhotoWithChecksum of a trashed photo = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.PhotoWithChecksum(ctx, other, "aaaa"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("another user's PhotoWithChecksum = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testImageMetadata(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	prefix := fmt.Sprintf("user_%d/", id)
+
+	for _, key := range []string{"a.jpg", "b.png"} {
+		if err := s.CreatePhoto(ctx, id, prefix+key, 10); err != nil {
+			t.Fatalf("CreatePhoto(%s): %v", key, err)
+		}
+	}
+
+	taken := time.Date(2023, 7, 14, 10, 20, 30, 0, time.UTC)
+	meta := types.ImageMetadata{
+		Width:    4000,
+		Height:   3000,
+		MIMEType: "image/jpeg",
+		Palette:  []string{"#102030", "#ffffff"},
+		BlurHash: "L00000fQfQfQfQfQfQfQfQfQfQfQ",
+		EXIF: &types.EXIF{
+			Make:        "Canon",
+			TakenAt:     &taken,
+			Orientation: 6,
+			FNumber:     2.8,
+			GPS:         &types.GPS{Latitude: -33.5, Longitude: 151.21},
+		},
+	}
+	if err := s.SetImageMetadata(ctx, prefix+"a.jpg", meta); err != nil {
+		t.Fatalf("SetImageMetadata: %v", err)
+	}
+	if err := s.SetImageMetadata(ctx, prefix+"missing.jpg", meta); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SetImageMetadata of a missing photo = %v, want sql.ErrNoRows", err)
+	}
+
+	metadata, err := s.ImageMetadata(ctx, []string{prefix + "a.jpg", prefix + "b.png", prefix + "missing.jpg"})
+	if err != nil {
+		t.Fatalf("ImageMetadata: %v", err)
+	}
+	if len(metadata) != 1 {
+		t.Errorf("ImageMetadata returned %d entries, want only a.jpg", len(metadata))
+	}
+	got, ok := metadata[prefix+"a.jpg"]
+	if !ok || got.Width != 4000 || got.Height != 3000 || got.MIMEType != "image/jpeg" || got.BlurHash != meta.BlurHash ||
+		strings.Join(got.Palette, ",") != "#102030,#ffffff" || got.EXIF == nil || got.EXIF.Make != "Canon" ||
+		got.EXIF.TakenAt == nil || !got.EXIF.TakenAt.Equal(taken) || got.EXIF.GPS == nil || got.EXIF.GPS.Longitude != 151.21 {
+		t.Errorf("ImageMetadata = %+v, want %+v", got, meta)
+	}
+}
+
+func testExports(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, _ := createUser(t, s)
+	other, _ := createUser(t, s)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	export, err := s.CreateExport(ctx, id, expires)
+	if err != nil {
+		t.Fatalf("CreateExport: %v", err)
+	}
+	if export.ID == 0 || export.CreatedAt.IsZero() || !export.ExpiresAt.Equal(expires) {
+		t.Errorf("CreateExport = %+v, want an ID, a creation time and expiry %s", export, expires)
+	}
+
+	if _, err := s.GetExport(ctx, other, export.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetExport by another user = %v, want sql.ErrNoRows", err)
+	}
+	got, err := s.GetExport(ctx, id, export.ID)
+	if err != nil {
+		t.Fatalf("GetExport: %v", err)
+	}
+	if got.UserID != id || got.CompletedAt != nil {
+		t.Errorf("GetExport = %+v, want an incomplete export of user %d", got, id)
+	}
+
+	if err := s.CompleteExport(ctx, export.ID); err != nil {
+		t.Fatalf("CompleteExport: %v", err)
+	}
+	first, _ := s.GetExport(ctx, id, export.ID)
+	if first.CompletedAt == nil {
+		t.Fatal("export is not complete")
+	}
+	if err := s.CompleteExport(ctx, export.ID); err != nil {
+		t.Fatalf("CompleteExport: %v", err)
+	}
+	if again, _ := s.GetExport(ctx, id, export.ID); !again.CompletedAt.Equal(*first.CompletedAt) {
+		t.Errorf("completing again moved the completion time from %s to %s", first.CompletedAt, again.CompletedAt)
+	}
+}
+
+func testDeleteUser(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	id, email := createUser(t, s)
+	other, _ := createUser(t, s)
+
+	key := fmt.Sprintf("user_%d/a.png", id)
+	if err := s.CreatePhoto(ctx, id, key, 10); err != nil {
+		t.Fatalf("CreatePhoto: %v", err)
+	}
+	album, err := s.CreateAlbum(ctx, id, "Deleted")
+	if err != nil {
+		t.Fatalf("CreateAlbum: %v", err)
+	}
+	if _, err := s.CreateShare(ctx, types.Share{Slug: fmt.Sprintf("deleted-%d", id), UserID: id, AlbumID: album.ID}); err != nil {
+		t.Fatalf("CreateShare: %v", err)
+	}
+	if err := s.LinkIdentity(ctx, id, "mock", email, email); err != nil {
+		t.Fatalf("LinkIdentity: %v", err)
+	}
+	otherKey := fmt.Sprintf("user_%d/b.png", other)
+	if err := s.CreatePhoto(ctx, other, otherKey, 10); err != nil {
+		t.Fatalf("CreatePhoto: %v", err)
+	}
+
+	deletion, err := s.DeleteUser(ctx, id)
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if deletion.ID == 0 || deletion.UserID != id || deletion.DeletedAt.IsZero() || deletion.ObjectsPurgedAt != nil {
+		t.Errorf("DeleteUser = %+v, want a pending deletion record of user %d", deletion, id)
+	}
+	if deletion.Photos != 1 || deletion.Albums != 1 || deletion.Shares != 1 {
+		t.Errorf("DeleteUser counted %d photos, %d albums and %d shares, want 1 of each", deletion.Photos, deletion.Albums, deletion.Shares)
+	}
+
+	if _, err := s.GetUserById(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserById after deletion = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.GetUserByEmail(ctx, email); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByEmail after deletion = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.GetUserByIdentity(ctx, "mock", email); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByIdentity after deletion = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.GetPhoto(ctx, id, key); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetPhoto after deletion = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.GetShare(ctx, fmt.Sprintf("deleted-%d", id)); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetShare after deletion = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.GetPhoto(ctx, other, otherKey); err != nil {
+		t.Errorf("deleting a user deleted another user's photo: %v", err)
+	}
+	if _, err := s.DeleteUser(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("deleting a user twice = %v, want sql.ErrNoRows", err)
+	}
+
+	// The email can be registered again
+	if err := s.CreateUser(ctx, email, "correct horse"); err != nil {
+		t.Errorf("CreateUser with the email of a deleted account: %v", err)
+	}
+
+	pending, err := s.PendingAccountPurges(ctx, 1000)
+	if err != nil {
+		t.Fatalf("PendingAccountPurges: %v", err)
+	}
+	if !hasDeletion(pending, deletion.ID) {
+		t.Fatalf("PendingAccountPurges = %+v, want deletion %d", pending, deletion.ID)
+	}
+	if err := s.MarkAccountPurged(ctx, deletion.ID); err != nil {
+		t.Fatalf("MarkAccountPurged: %v", err)
+	}
+	if pending, _ := s.PendingAccountPurges(ctx, 1000); hasDeletion(pending, deletion.ID) {
+		t.Error("a purged account is still pending")
+	}
+}
+
+func hasDeletion(deletions []types.AccountDeletion, id int) bool {
+	for _, deletion := range deletions {
+		if deletion.ID == id {
+			return true
+		}
+	}
+	return false
+}
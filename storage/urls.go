@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/alvarofc/mode/types"
+)
+
+// URLConfig controls the presigned links handed out for stored photos
+type URLConfig struct {
+	// TTL is how long listed URLs stay valid
+	TTL time.Duration
+	// SafetyWindow is the remaining lifetime below which a cached URL is no longer served
+	SafetyWindow time.Duration
+	// PublicHost replaces the scheme and host of presigned URLs when photos are served through a CDN
+	PublicHost *url.URL
+}
+
+// DefaultURLConfig presigns URLs for an hour and refreshes them five minutes before they expire
+var DefaultURLConfig = URLConfig{TTL: time.Hour, SafetyWindow: 5 * time.Minute}
+
+// URLConfigFromEnv reads PRESIGN_TTL, PRESIGN_SAFETY_WINDOW and S3_PUBLIC_HOST
+func URLConfigFromEnv() (URLConfig, error) {
+	cfg := DefaultURLConfig
+
+	var err error
+	if cfg.TTL, err = envDuration("PRESIGN_TTL", cfg.TTL); err != nil {
+		return cfg, err
+	}
+	if cfg.SafetyWindow, err = envDuration("PRESIGN_SAFETY_WINDOW", cfg.SafetyWindow); err != nil {
+		return cfg, err
+	}
+	if cfg.SafetyWindow < 0 || cfg.TTL <= cfg.SafetyWindow {
+		return cfg, fmt.Errorf("PRESIGN_TTL (%s) must be longer than PRESIGN_SAFETY_WINDOW (%s)", cfg.TTL, cfg.SafetyWindow)
+	}
+
+	if host := os.Getenv("S3_PUBLIC_HOST"); host != "" {
+		u, err := url.Parse(host)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return cfg, fmt.Errorf("S3_PUBLIC_HOST must be an absolute URL such as https://cdn.example.com, got %q", host)
+		}
+		cfg.PublicHost = u
+	}
+
+	return cfg, nil
+}
+
+// rewrite points a presigned URL at the public host, keeping its path and signature
+func (c URLConfig) rewrite(presigned string) (string, error) {
+	if c.PublicHost == nil {
+		return presigned, nil
+	}
+	u, err := url.Parse(presigned)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = c.PublicHost.Scheme
+	u.Host = c.PublicHost.Host
+	return u.String(), nil
+}
+
+// fresh reports whether a cached URL still has more than the safety window left
+func (c URLConfig) fresh(images ...types.ImageInfo) bool {
+	for _, img := range images {
+		if time.Until(img.URLExpires) <= c.SafetyWindow {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheTTL shortens ttl so that cached images are dropped before their URLs leave the safety window
+// A result of zero or less means the images should not be cached at all.
+func (c URLConfig) cacheTTL(ttl time.Duration, images ...types.ImageInfo) time.Duration {
+	for _, img := range images {
+		if limit := time.Until(img.URLExpires) - c.SafetyWindow; limit < ttl {
+			ttl = limit
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,134 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The RFC 4226 and RFC 6238 test secret, "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, w := range want {
+		if got := code([]byte("12345678901234567890"), uint64(counter)); got != w {
+			t.Errorf("code(%d) = %s, want %s", counter, got, w)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, keeping the last six of the eight digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("Code(%d): %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	got, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", time.Unix(59, 0))
+	if err != nil || got != "287082" {
+		t.Errorf("Code = %s, %v, want 287082", got, err)
+	}
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+	if _, err := Code("not base32!", time.Now()); err == nil {
+		t.Error("Code accepted an invalid secret")
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / int64(Period.Seconds())
+
+	tests := []struct {
+		offset int64
+		valid  bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		c := code([]byte("12345678901234567890"), uint64(step+tt.offset))
+		gotStep, ok := ValidateStep(c, rfcSecret, now)
+		if ok != tt.valid {
+			t.Errorf("offset %d: valid = %v, want %v", tt.offset, ok, tt.valid)
+			continue
+		}
+		// The step is what callers record to refuse the code a second time
+		if ok && gotStep != step+tt.offset {
+			t.Errorf("offset %d: step = %d, want %d", tt.offset, gotStep, step+tt.offset)
+		}
+		if Validate(c, rfcSecret, now) != tt.valid {
+			t.Errorf("offset %d: Validate disagrees with ValidateStep", tt.offset)
+		}
+	}
+}
+
+func TestValidateStepReplay(t *testing.T) {
+	// The same code checked again later in its window resolves to the same step, so a
+	// caller that stores used steps can refuse it
+	first := time.Unix(1111111110, 0)
+	c, err := Code(rfcSecret, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step1, ok1 := ValidateStep(c, rfcSecret, first)
+	step2, ok2 := ValidateStep(c, rfcSecret, first.Add(Period))
+	if !ok1 || !ok2 {
+		t.Fatalf("code rejected: %v, %v", ok1, ok2)
+	}
+	if step1 != step2 {
+		t.Errorf("steps differ: %d, %d", step1, step2)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name, code, secret string
+	}{
+		{"wrong code", "000000", rfcSecret},
+		{"short code", "50471", rfcSecret},
+		{"long code", "0504710", rfcSecret},
+		{"empty code", "", rfcSecret},
+		{"invalid secret", "050471", "not base32!"},
+	}
+	for _, tt := range tests {
+		if Validate(tt.code, tt.secret, now) {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestValidateNearEpoch(t *testing.T) {
+	// The window before step 0 doesn't exist and must not match anything
+	c := code([]byte("12345678901234567890"), 0)
+	if step, ok := ValidateStep(c, rfcSecret, time.Unix(0, 0)); !ok || step != 0 {
+		t.Errorf("ValidateStep = %d, %v, want 0, true", step, ok)
+	}
+	if Validate("", rfcSecret, time.Unix(0, 0)) {
+		t.Error("empty code accepted at the epoch")
+	}
+}
@@ -0,0 +1,25 @@
+package types
+
+import "time"
+
+// Identity is an external (OIDC) account linked to a user
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AccountDeletion is the record kept of a deleted account; it holds no personal data, only what
+// was deleted and when
+type AccountDeletion struct {
+	ID     int `json:"id"`
+	UserID int `json:"user_id"`
+	// Photos, Albums and Shares count the catalog rows deleted with the account
+	Photos    int       `json:"photos"`
+	Albums    int       `json:"albums"`
+	Shares    int       `json:"shares"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// ObjectsPurgedAt is when the account's files were removed from storage, nil until then
+	ObjectsPurgedAt *time.Time `json:"objects_purged_at"`
+}
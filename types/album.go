@@ -0,0 +1,14 @@
+package types
+
+import "time"
+
+// Album is a named, ordered collection of a user's photos
+type Album struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	Name   string `json:"name"`
+	// CoverKey is the photo shown for the album, empty to use the first one
+	CoverKey   string    `json:"cover_key,omitempty"`
+	PhotoCount int       `json:"photo_count"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -0,0 +1,21 @@
+package types
+
+import "time"
+
+// Export is a request to download a user's whole photo library as a ZIP archive
+// The archive isn't stored: it is built while it is downloaded, as often as needed until the export expires.
+type Export struct {
+	ID     int `json:"id"`
+	UserID int `json:"user_id"`
+	// URL is where the archive is downloaded, filled in by the API
+	URL       string    `json:"url,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// CompletedAt is when the archive was first downloaded in full
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// Expired reports whether the export can no longer be downloaded at t
+func (e Export) Expired(t time.Time) bool {
+	return !t.Before(e.ExpiresAt)
+}
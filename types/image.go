@@ -0,0 +1,38 @@
+package types
+
+import "time"
+
+// ImageMetadata is what clients need to lay out and preview a photo without downloading it
+type ImageMetadata struct {
+	// Width and Height are as displayed, after applying the EXIF orientation
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	MIMEType string `json:"mime_type,omitempty"`
+	// Palette lists the dominant colors as #rrggbb, most common first
+	Palette  []string `json:"palette,omitempty"`
+	BlurHash string   `json:"blurhash,omitempty"`
+	EXIF     *EXIF    `json:"exif,omitempty"`
+}
+
+// EXIF holds the camera fields read from an image; zero fields were absent
+type EXIF struct {
+	Make        string     `json:"make,omitempty"`
+	Model       string     `json:"model,omitempty"`
+	LensModel   string     `json:"lens_model,omitempty"`
+	Software    string     `json:"software,omitempty"`
+	TakenAt     *time.Time `json:"taken_at,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+	// ExposureTime is in seconds, FocalLength in millimetres
+	ExposureTime float64 `json:"exposure_time,omitempty"`
+	FNumber      float64 `json:"f_number,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	FocalLength  float64 `json:"focal_length,omitempty"`
+	GPS          *GPS    `json:"gps,omitempty"`
+}
+
+// GPS is where a photo was taken, in decimal degrees and metres above sea level
+type GPS struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude,omitempty"`
+}
@@ -8,8 +8,52 @@ type Photo struct {
 }
 
 type ImageInfo struct {
-	URL      string
-	Key      string
-	Size     int64
-	Modified time.Time
+	URL string
+	// URLExpires is when URL stops working
+	URLExpires time.Time
+	Key        string
+	Size       int64
+	Modified   time.Time
+	ImageMetadata
+}
+
+// TrashedPhoto is a soft-deleted photo that can be restored until it is purged
+type TrashedPhoto struct {
+	Key       string    `json:"key"`
+	UserID    int       `json:"user_id"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// Photo sources recorded in the catalog
+const (
+	PhotoSourceUpload    = "upload"
+	PhotoSourceGenerated = "generated"
+)
+
+// PhotoMetadata describes what a photo depicts and how it was made
+type PhotoMetadata struct {
+	Source string `json:"source"`
+	// Prompt and GenerationParams are set for generated images
+	Prompt           string                 `json:"prompt"`
+	GenerationParams map[string]interface{} `json:"generation_params"`
+	Tags             []string               `json:"tags"`
+}
+
+// PhotoDetails is a catalog entry: the stored object and its metadata
+type PhotoDetails struct {
+	ImageInfo
+	PhotoMetadata
+	// Rank is the relevance of the photo to a search, higher first
+	Rank float64 `json:"rank,omitempty"`
+	// Hash is the perceptual hash of the image, nil until it has been computed
+	Hash *uint64 `json:"-"`
+}
+
+// SimilarPhoto is a photo found by its perceptual hash
+type SimilarPhoto struct {
+	ImageInfo
+	// Distance is the number of bits its hash differs by, 0 for a visually identical image
+	Distance int `json:"distance"`
 }
@@ -0,0 +1,33 @@
+package types
+
+import "time"
+
+// Share is a public link to a photo or an album
+type Share struct {
+	ID   int    `json:"id"`
+	Slug string `json:"slug"`
+	// URL is where the share is served, filled in by the API
+	URL    string `json:"url,omitempty"`
+	UserID int    `json:"user_id"`
+	// Exactly one of PhotoKey and AlbumID is set
+	PhotoKey string `json:"photo_key,omitempty"`
+	AlbumID  int    `json:"album_id,omitempty"`
+	// PasswordHash is the bcrypt hash of the share password, empty when there is none
+	PasswordHash string     `json:"-"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	// MaxDownloads is zero when downloads are unlimited
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Views        int       `json:"views"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Protected reports whether the share asks for a password
+func (s Share) Protected() bool {
+	return s.PasswordHash != ""
+}
+
+// Expired reports whether the share has expired at t
+func (s Share) Expired(t time.Time) bool {
+	return s.ExpiresAt != nil && !t.Before(*s.ExpiresAt)
+}
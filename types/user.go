@@ -1,8 +1,18 @@
 package types
 
+import "time"
+
 type User struct {
-	ID       int    `json:"id,omitempty"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Name     string `json:"name,omitempty"`
+	ID            int    `json:"id,omitempty"`
+	Email         string `json:"email"`
+	Password      string `json:"password"`
+	Name          string `json:"name,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+	TOTPEnabled   bool   `json:"totp_enabled"`
+	TOTPSecret    string `json:"-"`
+	// StripMetadata removes EXIF and other metadata from the stored copy of uploads
+	StripMetadata bool `json:"strip_metadata"`
+	// PasswordChangedAt is when the password last changed, zero if it never has; sessions issued
+	// before it are no longer accepted
+	PasswordChangedAt time.Time `json:"-"`
 }